@@ -8,9 +8,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
-	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/cathalgarvey/formadoor/clock"
 )
 
 var (
@@ -29,11 +30,16 @@ type jsonAPIRequest struct {
 	When    int64 // Unix time, must be recent for validity
 }
 
-func (jar jsonAPIRequest) validTime() bool {
-	return (time.Now().UTC().Unix() < jar.When+5)
+// serviceClock tells the time request timestamps are checked against.
+var serviceClock clock.Clock = clock.Real{}
+
+// validTime reports whether the request was made within the last five
+// seconds by c.
+func (jar jsonAPIRequest) validTime(c clock.Clock) bool {
+	return (c.Now().UTC().Unix() < jar.When+5)
 }
 
-func getAuthenticatedBody(r *http.Request) (*jsonAPIRequest, error) {
+func getAuthenticatedBody(r *http.Request, c clock.Clock) (*jsonAPIRequest, error) {
 	var jar jsonAPIRequest
 	bodyContents, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -65,7 +71,7 @@ MACAuthed:
 	if err != nil {
 		return nil, err
 	}
-	if !jar.validTime() {
+	if !jar.validTime(c) {
 		return nil, ErrOutdatedMAC
 	}
 	log15.Info("Timestamp accepted for authenticated message", log15.Ctx{"key": authedKey, "jsonRequest": jar})
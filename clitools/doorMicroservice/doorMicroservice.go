@@ -57,7 +57,7 @@ func serve(unlockCallback func(int)) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Check for a HMAC header to authenticate body, and verify that
 		// authenticated body has a recent timestamp.
-		authedRequest, err := getAuthenticatedBody(r)
+		authedRequest, err := getAuthenticatedBody(r, serviceClock)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(err.Error()))
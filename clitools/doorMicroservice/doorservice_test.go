@@ -2,8 +2,23 @@ package main
 
 import (
 	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestServer(t *testing.T) {
 	serve(testUnlockingFunction)
 }
+
+func TestValidTime(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1460108220, 0))
+	jar := jsonAPIRequest{Seconds: 5, When: fake.Now().Unix()}
+	assert.True(t, jar.validTime(fake))
+	fake.Advance(4 * time.Second)
+	assert.True(t, jar.validTime(fake))
+	// Requests go stale after five seconds.
+	fake.Advance(time.Second)
+	assert.False(t, jar.validTime(fake))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	analyseCmd          = kingpin.Command("analyse", "Estimate brute force and code collision risk for an accounts file")
+	analyseAccountsFile = analyseCmd.Arg("accounts", accountsHelp).Required().String()
+)
+
+// analyse prints the risk analysis of an accounts file, given the configured
+// rate limit, followed by any warnings.
+func analyse() {
+	loadAccounts(*analyseAccountsFile)
+	a := totps.Analyse()
+	fmt.Printf("Keys:                           %d\n", a.Keys)
+	fmt.Printf("Rate limit:                     %s\n", totps.RateLimitDelay())
+	fmt.Printf("Best guess length:              %d digits\n", a.GuessDigits)
+	fmt.Printf("Chance a guess succeeds:        %.3g\n", a.AttemptSuccess)
+	fmt.Printf("Expected time to brute force:   %.1f days\n", a.TimeToBreak.Hours()/24)
+	fmt.Printf("Chance members share a code:    %.3g\n", a.Collision)
+	for _, warning := range a.Warnings(totpset.DefaultThresholds) {
+		fmt.Println("WARNING: " + warning)
+	}
+}
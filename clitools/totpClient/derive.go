@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	masterKeyFile = kingpin.Flag("master-keyfile", "File holding the master key that derived member secrets come from").ExistingFile()
+
+	masterKeyCmd  = kingpin.Command("master-key", "Write a new random master key to a file, for members' secrets to be derived from rather than stored")
+	masterKeyPath = masterKeyCmd.Arg("file", "File to write; it must not already exist").Required().String()
+
+	reenrollCmd          = kingpin.Command("reenroll", "Give a member a new secret, eg. after losing their phone, and show its QR code; their old codes stop working")
+	reenrollAccountsFile = reenrollCmd.Arg("accounts", accountsHelp).Required().String()
+	reenrollName         = reenrollCmd.Arg("name", "Name of the member").Required().String()
+	reenrollIssuer       = reenrollCmd.Flag("issuer", "Name the door is shown under in the member's authenticator app").Default("Forma Door").String()
+)
+
+// masterKeySize is the length of the master keys written by master-key.
+const masterKeySize = 32
+
+// errMasterKey is returned for a master keyfile that isn't as written by
+// master-key, eg. one that has been truncated.
+var errMasterKey = errors.New("Master keyfile must hold a base64 encoded key of 32 bytes, as written by master-key")
+
+// masterKey returns the master key in the master keyfile, or nil if none was
+// given. A keyfile that has been damaged is refused, rather than quietly
+// deriving different secrets from it.
+func masterKey() ([]byte, error) {
+	if *masterKeyFile == "" {
+		return nil, nil
+	}
+	encoded, err := readPassphrase(*masterKeyFile, "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil || len(key) != masterKeySize {
+		return nil, errMasterKey
+	}
+	return key, nil
+}
+
+// writeMasterKey writes a new random master key to a file only its owner can
+// read.
+func writeMasterKey() error {
+	key := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*masterKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return err
+	}
+	fmt.Println("Wrote a new master key to " + *masterKeyPath + ". Back it up somewhere safe: without it no derived secret can be recovered.")
+	return nil
+}
+
+// reenroll moves a member with a derived secret on to its next generation, or
+// gives a member with a stored secret a new random one, and shows it.
+func reenroll() error {
+	store, err := openStore(*reenrollAccountsFile)
+	if err != nil {
+		return err
+	}
+	k, err := store.Get(*reenrollName)
+	if err != nil {
+		return err
+	}
+	if k.Type == totpset.Guest {
+		return errors.New("Guest codes can't be re-enrolled, mint a new one")
+	}
+	if k.Derivation != nil {
+		master, err := masterKey()
+		if err != nil {
+			return err
+		}
+		if err = k.Reenroll(master); err != nil {
+			return err
+		}
+	} else if k.Secret, err = totpset.GenerateSecret(totpset.DefaultSecretSize); err != nil {
+		return err
+	}
+	// Codes from the old secret are no longer valid, so neither is the
+	// Counter or Drift learned from them.
+	k.Counter = 0
+	k.Drift = 0
+	if err = store.Save(k); err != nil {
+		return err
+	}
+	fmt.Println("Re-enrolled " + k.Name + ". Scan this code with an authenticator app, replacing the old account:")
+	if err = k.WriteQRTerminal(os.Stdout, *reenrollIssuer); err != nil {
+		return err
+	}
+	fmt.Println(k.URI(*reenrollIssuer))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	duressLastDigit = kingpin.Flag("duress-last-digit", "Also accept each code with its last digit increased by one (9 becoming 0) as a duress code").Default("false").Bool()
+	duressCommand   = kingpin.Flag("duress-command", "Shell command to run when a duress code is entered, eg. to send an alert; the member's name and email are in $DURESS_NAME and $DURESS_EMAIL").String()
+)
+
+// raiseDuress logs a duress code entered for who at the highest level, and
+// runs the duress command if there is one. The command runs in the
+// background, so the door opens as quickly as it would for any other member.
+func raiseDuress(who *totpset.Key, code string) {
+	account, _ := accountOf(who)
+	log15.Crit("DURESS: code entered under duress", log15.Ctx{"who": who.Name, "email": account.Email, "code": code})
+	if *duressCommand == "" {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", *duressCommand)
+	cmd.Env = append(os.Environ(), "DURESS_NAME="+who.Name, "DURESS_EMAIL="+account.Email)
+	go func() {
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log15.Crit("Duress command failed", log15.Ctx{"who": who.Name, "err": err, "output": string(output)})
+		}
+	}()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+	"golang.org/x/term"
+)
+
+var (
+	keyFile = kingpin.Flag("keyfile", "File whose contents are the passphrase of an encrypted accounts file; otherwise it is asked for").ExistingFile()
+
+	encryptCmd          = kingpin.Command("encrypt", "Encrypt a plain accounts file in place")
+	encryptAccountsFile = encryptCmd.Arg("accounts", "Accounts JSON File; bolt databases can't be encrypted").Required().String()
+	encryptKeyFile      = encryptCmd.Flag("new-keyfile", "File whose contents are the passphrase to encrypt with; otherwise it is asked for").ExistingFile()
+
+	rekeyCmd          = kingpin.Command("rekey", "Change the passphrase of an encrypted accounts file")
+	rekeyAccountsFile = rekeyCmd.Arg("accounts", "Accounts JSON File").Required().String()
+	rekeyKeyFile      = rekeyCmd.Flag("new-keyfile", "File whose contents are the new passphrase; otherwise it is asked for").ExistingFile()
+
+	editCmd          = kingpin.Command("edit", "Show, add, change or delete an account, without writing an encrypted accounts file out in plain")
+	editAccountsFile = editCmd.Arg("accounts", accountsHelp).Required().String()
+	editName         = editCmd.Arg("name", "Name of the account").Required().String()
+	editFields       = editCmd.Flag("set", "Set a field of the account, as named in the accounts file, eg. --set 'time policy=[Mon:Fri]09:00->17:00'").StringMap()
+	editDelete       = editCmd.Flag("delete", "Delete the account").Bool()
+)
+
+// stdin reads passphrases when they aren't typed at a terminal, eg. when
+// piped in by a script. It is shared so that nothing read ahead is lost.
+var stdin = bufio.NewReader(os.Stdin)
+
+// numericFields and booleanFields are the fields of an account that --set
+// parses as numbers and as true or false.
+var (
+	numericFields = map[string]bool{"digits": true, "period": true, "skew": true, "counter": true, "look ahead": true, "drift": true}
+	booleanFields = map[string]bool{"suspended": true}
+)
+
+// openAccountsFile returns the store for the accounts file fn, asking for its
+// passphrase if it is encrypted.
+func openAccountsFile(fn string) (*totpset.JSONFileStore, error) {
+	store := totpset.NewJSONFileStore(fn)
+	encrypted, err := store.Encrypted()
+	if err != nil || !encrypted {
+		return store, err
+	}
+	passphrase, err := readPassphrase(*keyFile, "Passphrase for "+fn+": ")
+	if err != nil {
+		return nil, err
+	}
+	return totpset.NewEncryptedFileStore(fn, passphrase), nil
+}
+
+// readPassphrase returns the contents of keyFile, less any final newline, or
+// if no keyFile is given asks for a passphrase with prompt.
+func readPassphrase(keyFile, prompt string) ([]byte, error) {
+	if keyFile != "" {
+		contents, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(contents, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return term.ReadPassword(int(os.Stdin.Fd()))
+	}
+	line, err := stdin.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// newPassphrase returns the contents of keyFile, or asks for a new passphrase
+// twice to be sure of it.
+func newPassphrase(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return readPassphrase(keyFile, "")
+	}
+	passphrase, err := readPassphrase("", "New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassphrase("", "New passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("Passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// encrypt encrypts a plain accounts file with a new passphrase.
+func encrypt() error {
+	if strings.HasPrefix(*encryptAccountsFile, boltPrefix) {
+		return errBoltEncrypted
+	}
+	store := totpset.NewJSONFileStore(*encryptAccountsFile)
+	encrypted, err := store.Encrypted()
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		return errors.New("Accounts file is already encrypted, use rekey to change its passphrase")
+	}
+	passphrase, err := newPassphrase(*encryptKeyFile)
+	if err != nil {
+		return err
+	}
+	return store.Encrypt(passphrase)
+}
+
+// rekey changes the passphrase of an encrypted accounts file.
+func rekey() error {
+	if strings.HasPrefix(*rekeyAccountsFile, boltPrefix) {
+		return errBoltEncrypted
+	}
+	store, err := openAccountsFile(*rekeyAccountsFile)
+	if err != nil {
+		return err
+	}
+	// Check the current passphrase before asking for a new one.
+	if _, err = store.Load(); err != nil {
+		return err
+	}
+	passphrase, err := newPassphrase(*rekeyKeyFile)
+	if err != nil {
+		return err
+	}
+	return store.Encrypt(passphrase)
+}
+
+// edit shows, changes or deletes an account in place, decrypting it only in
+// memory. Setting fields of an account that doesn't exist adds it.
+func edit() error {
+	store, err := openStore(*editAccountsFile)
+	if err != nil {
+		return err
+	}
+	if *editDelete {
+		return store.Delete(*editName)
+	}
+	k, err := store.Get(*editName)
+	if err == totpset.ErrKeyNotFound && len(*editFields) > 0 {
+		k = totpset.NewKey(*editName, "")
+	} else if err != nil {
+		return err
+	}
+	if len(*editFields) > 0 {
+		if k, err = setFields(k, *editFields); err != nil {
+			return err
+		}
+		if k.Secret == "" && k.Derivation == nil {
+			return errors.New("Account has no secret")
+		}
+		if err = store.Save(k); err != nil {
+			return err
+		}
+	}
+	// Show the account, but not its secrets.
+	shown := *k
+	shown.Secret = "(hidden)"
+	if shown.DuressSecret != "" {
+		shown.DuressSecret = "(hidden)"
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(shown)
+}
+
+// setFields returns a copy of k with the given fields, as named in the
+// accounts file, changed.
+func setFields(k *totpset.Key, fields map[string]string) (*totpset.Key, error) {
+	encoded, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	if err = json.Unmarshal(encoded, &record); err != nil {
+		return nil, err
+	}
+	for field, value := range fields {
+		if field == "name" {
+			return nil, errors.New("Can't rename an account, delete it and add it again")
+		}
+		record[field] = value
+		if numericFields[field] {
+			var number float64
+			if err = json.Unmarshal([]byte(value), &number); err != nil {
+				return nil, errors.New("Field '" + field + "' must be a number")
+			}
+			record[field] = number
+		}
+		if booleanFields[field] {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("Field '" + field + "' must be true or false")
+			}
+			record[field] = flag
+		}
+	}
+	if encoded, err = json.Marshal(record); err != nil {
+		return nil, err
+	}
+	edited := new(totpset.Key)
+	return edited, json.Unmarshal(encoded, edited)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/timepolicy"
+	"github.com/cathalgarvey/formadoor/totpset"
+	"github.com/pquerna/otp"
+)
+
+var (
+	enrollCmd          = kingpin.Command("enroll", "Add a member with a newly generated secret, and show the QR code for their authenticator app")
+	enrollAccountsFile = enrollCmd.Arg("accounts", accountsHelp).Required().String()
+	enrollName         = enrollCmd.Arg("name", "Name of the new member").Required().String()
+	enrollTimePolicy   = enrollCmd.Flag("time-policy", "When the member may enter, eg. '[Sat:Sun]12:00->17:00|[Mon:Fri]08:45->18:30'").Required().String()
+	enrollEmail        = enrollCmd.Flag("email", "Member's email address").String()
+	enrollMemberNumber = enrollCmd.Flag("member-number", "Number the member may type before their code").String()
+	enrollDigits       = enrollCmd.Flag("digits", "Code length").Default("6").Enum("6", "8")
+	enrollPeriod       = enrollCmd.Flag("period", "Seconds each code lasts").Default("30").Uint()
+	enrollAlgorithm    = enrollCmd.Flag("algorithm", "Hash algorithm; not all authenticator apps support those other than SHA1").Default("SHA1").Enum("SHA1", "SHA256", "SHA512")
+	enrollIssuer       = enrollCmd.Flag("issuer", "Name the door is shown under in the member's authenticator app").Default("Forma Door").String()
+	enrollPNG          = enrollCmd.Flag("png", "Also write the QR code to this PNG file, eg. to email it; delete it once used").String()
+	enrollDuress       = enrollCmd.Flag("duress", "Also generate a duress secret, whose codes open the door but raise the alarm, and show its QR code; not with --derive, as it would be stored").Bool()
+	enrollQuota        = enrollCmd.Flag("quota", "Visits the member may make, eg. 10 for a ten visit pass, or 10/month; day, week and month are supported").String()
+	enrollDerive       = enrollCmd.Flag("derive", "Derive the member's secret from the --master-keyfile, storing only their ID and generation").Bool()
+	enrollMemberID     = enrollCmd.Flag("member-id", "ID the member's secret is derived from with --derive; their name if not given").String()
+)
+
+// enroll generates a Key for a new member, adds it to the accounts file and
+// shows it as a QR code for the member to scan.
+func enroll() error {
+	if _, err := timepolicy.ParsePolicy(*enrollTimePolicy); err != nil {
+		return err
+	}
+	if *enrollDerive && *enrollDuress {
+		return errors.New("A duress secret can't be derived, so would be stored; use --duress-last-digit for duress codes instead")
+	}
+	store, err := openStore(*enrollAccountsFile)
+	if err != nil {
+		return err
+	}
+	if _, err = store.Get(*enrollName); err == nil {
+		return errors.New("There is already an account named " + *enrollName)
+	} else if err != totpset.ErrKeyNotFound {
+		return err
+	}
+	k, err := newEnrollKey()
+	if err != nil {
+		return err
+	}
+	account := FormiteAccount{Name: k.Name, Email: *enrollEmail, TimePolicy: *enrollTimePolicy}
+	if *enrollQuota != "" {
+		if account.Quota, err = totpset.ParseQuota(*enrollQuota); err != nil {
+			return err
+		}
+	}
+	account.applyTo(k)
+	k.MemberNumber = *enrollMemberNumber
+	// Defaults are left unset, to keep the accounts file tidy.
+	if digits, _ := strconv.Atoi(*enrollDigits); digits != int(otp.DigitsSix) {
+		k.Digits = otp.Digits(digits)
+	}
+	if *enrollPeriod != totpset.DefaultPeriod {
+		k.Period = *enrollPeriod
+	}
+	if k.Algorithm, err = totpset.ParseAlgorithm(*enrollAlgorithm); err != nil {
+		return err
+	}
+	if *enrollDuress {
+		if k.DuressSecret, err = totpset.GenerateSecret(totpset.DefaultSecretSize); err != nil {
+			return err
+		}
+	}
+	// Open the PNG file first, so as not to enroll anyone if it can't be.
+	var pngFile *os.File
+	if *enrollPNG != "" {
+		if pngFile, err = os.OpenFile(*enrollPNG, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+		defer pngFile.Close()
+	}
+	if err = store.Save(k); err != nil {
+		return err
+	}
+	if pngFile != nil {
+		if err = k.WriteQRPNG(pngFile, *enrollIssuer, 512); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Enrolled " + k.Name + ". Scan this code with an authenticator app:")
+	if err = k.WriteQRTerminal(os.Stdout, *enrollIssuer); err != nil {
+		return err
+	}
+	fmt.Println(k.URI(*enrollIssuer))
+	if k.DuressSecret == "" {
+		return nil
+	}
+	// The duress secret is enrolled as a second account in the same app,
+	// named so the member can tell which is which.
+	duress := *k
+	duress.Name = k.Name + " (duress)"
+	duress.Secret = k.DuressSecret
+	fmt.Println("And this code is for the duress account, to use only if forced to open the door:")
+	if err = duress.WriteQRTerminal(os.Stdout, *enrollIssuer); err != nil {
+		return err
+	}
+	fmt.Println(duress.URI(*enrollIssuer))
+	return nil
+}
+
+// newEnrollKey returns a Key for the new member, with a random secret, or one
+// derived from the master key with --derive.
+func newEnrollKey() (*totpset.Key, error) {
+	if !*enrollDerive {
+		return totpset.NewRandomKey(*enrollName)
+	}
+	master, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	id := *enrollMemberID
+	if id == "" {
+		id = *enrollName
+	}
+	k := totpset.NewKey(*enrollName, totpset.Derivation{MemberID: id, Generation: 1}.String())
+	if k.Derivation == nil {
+		return nil, totpset.ErrDerivationSpec
+	}
+	return k, k.Derive(master)
+}
@@ -1,18 +1,42 @@
 package main
 
-import "github.com/cathalgarvey/formadoor/timepolicy"
+import (
+	"github.com/cathalgarvey/formadoor/timepolicy"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
 
-// FormiteAccount represents an account on the Forma Door
+// FormiteAccount represents an account on the Forma Door: the details kept
+// alongside each member's TOTP secret and parameters in the accounts file.
 type FormiteAccount struct {
-	Name       string `json:"name"`
-	Email      string `json:"email"`
-	TimePolicy string `json:"time policy"`
-	Secret     string `json:"secret"`
+	Name       string
+	Email      string
+	TimePolicy string
+	// Quota, if set, limits the member's visits, eg. for a ten visit pass.
+	Quota *totpset.Quota
+}
+
+// accountOf returns the account details of a Key read from the accounts file,
+// which totpset.JSONFileStore leaves in its Metadata under their names in the
+// file. It returns false if the Key has no time policy.
+func accountOf(k *totpset.Key) (FormiteAccount, bool) {
+	policy, present := k.Metadata["time policy"].(string)
+	email, _ := k.Metadata["email"].(string)
+	return FormiteAccount{Name: k.Name, Email: email, TimePolicy: policy, Quota: k.Quota}, present
+}
+
+// applyTo sets the account details in k's Metadata, where accountOf finds
+// them, leaving out an empty Email.
+func (fa FormiteAccount) applyTo(k *totpset.Key) {
+	if fa.Email != "" {
+		k.Metadata["email"] = fa.Email
+	}
+	k.Metadata["time policy"] = fa.TimePolicy
+	k.Quota = fa.Quota
 }
 
 // AccessPolicy returns the timepolicy.Policy object represented by the
 // TimePolicy property of this account. This can then be queried with
-// policy.ContainsTime(time.Now()) to test whether the user is permitted
+// policy.ContainsNow(totps.Clock) to test whether the member is permitted
 // access at the present moment.
 func (fa FormiteAccount) AccessPolicy() (*timepolicy.Policy, error) {
 	return timepolicy.ParsePolicy(fa.TimePolicy)
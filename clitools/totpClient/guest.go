@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/timepolicy"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+// anyTime is the time policy of guest codes not restricted to any times.
+const anyTime = "[Mon:Sun]00:00->23:59"
+
+var (
+	guestCmd = kingpin.Command("guest", "Manage single-use guest codes")
+
+	guestMintCmd          = guestCmd.Command("mint", "Issue a guest code, which lets one person in before it expires")
+	guestMintAccountsFile = guestMintCmd.Arg("accounts", accountsHelp).Required().String()
+	guestMintName         = guestMintCmd.Arg("name", "Name for the guest code, eg. 'plumber 2026-10-17'").Required().String()
+	guestMintIssuedBy     = guestMintCmd.Flag("issued-by", "Name of the admin issuing the code, for the logs").Required().String()
+	guestMintExpires      = guestMintCmd.Flag("expires", "How long the code lasts if unused").Default("24h").Duration()
+	guestMintTimePolicy   = guestMintCmd.Flag("time-policy", "When the code may be used, eg. '[Thu:Thu]18:00->22:00'").Default(anyTime).String()
+	guestMintLength       = guestMintCmd.Flag("length", "Code length").Default("8").Int()
+
+	guestListCmd          = guestCmd.Command("list", "List guest codes and whether they have been used")
+	guestListAccountsFile = guestListCmd.Arg("accounts", accountsHelp).Required().String()
+
+	guestRevokeCmd          = guestCmd.Command("revoke", "Delete a guest code, used or not")
+	guestRevokeAccountsFile = guestRevokeCmd.Arg("accounts", accountsHelp).Required().String()
+	guestRevokeName         = guestRevokeCmd.Arg("name", "Name of the guest code").Required().String()
+)
+
+// guestMint adds a new guest code to the accounts file and prints it.
+func guestMint() error {
+	if _, err := timepolicy.ParsePolicy(*guestMintTimePolicy); err != nil {
+		return err
+	}
+	store, err := openStore(*guestMintAccountsFile)
+	if err != nil {
+		return err
+	}
+	if _, err = store.Get(*guestMintName); err == nil {
+		return errors.New("There is already an account named " + *guestMintName)
+	} else if err != totpset.ErrKeyNotFound {
+		return err
+	}
+	k, err := totpset.NewGuestKey(*guestMintName, *guestMintIssuedBy, *guestMintLength, time.Now().Add(*guestMintExpires))
+	if err != nil {
+		return err
+	}
+	FormiteAccount{Name: k.Name, TimePolicy: *guestMintTimePolicy}.applyTo(k)
+	if err = store.Save(k); err != nil {
+		return err
+	}
+	fmt.Printf("Guest code for %s: %s\n", k.Name, k.Secret)
+	fmt.Printf("Valid once, until %s, at %s\n", k.NotAfter.Format("2006-01-02 15:04"), *guestMintTimePolicy)
+	return nil
+}
+
+// guestList prints every guest code in the accounts file.
+func guestList() error {
+	store, err := openStore(*guestListAccountsFile)
+	if err != nil {
+		return err
+	}
+	keys, err := store.Load()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	fmt.Printf("%-24s %-16s %-8s %-16s %-16s %s\n", "Name", "Code", "Status", "Expires", "Issued by", "Time policy")
+	for _, k := range keys {
+		if k.Type != totpset.Guest {
+			continue
+		}
+		status := "unused"
+		if err := k.CheckActive(now); err == totpset.ErrGuestCodeUsed {
+			status = "used"
+		} else if err != nil {
+			status = "expired"
+		}
+		account, _ := accountOf(k)
+		fmt.Printf("%-24s %-16s %-8s %-16s %-16s %s\n", k.Name, k.Secret, status, k.NotAfter.Format("2006-01-02 15:04"), k.IssuedBy, account.TimePolicy)
+	}
+	return nil
+}
+
+// guestRevoke deletes a guest code from the accounts file.
+func guestRevoke() error {
+	store, err := openStore(*guestRevokeAccountsFile)
+	if err != nil {
+		return err
+	}
+	k, err := store.Get(*guestRevokeName)
+	if err != nil {
+		return err
+	}
+	if k.Type != totpset.Guest {
+		return errors.New(k.Name + " is a member, not a guest code; use edit --delete to remove members")
+	}
+	return store.Delete(k.Name)
+}
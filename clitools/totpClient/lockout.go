@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	lockoutFailures = kingpin.Flag("lockout-failures", "Failed authentications within --lockout-window that lock the keypad out and raise the alarm; 0 to disable").Default(strconv.Itoa(totpset.DefaultBruteForcePolicy.Failures)).Int()
+	lockoutWindow   = kingpin.Flag("lockout-window", "Window failed authentications are counted over for a lockout").Default(totpset.DefaultBruteForcePolicy.Window.String()).Duration()
+	lockoutFirst    = kingpin.Flag("lockout", "Length of the first lockout, doubling with each in a row").Default(totpset.DefaultBruteForcePolicy.Lockout.String()).Duration()
+	lockoutMax      = kingpin.Flag("lockout-max", "Longest lockout").Default(totpset.DefaultBruteForcePolicy.MaxLockout.String()).Duration()
+	alarmCommand    = kingpin.Flag("alarm-command", "Shell command to run on a lockout, eg. to send an alert; the details are in $ALARM_FAILURES, $ALARM_WINDOW, $ALARM_LOCKOUTS, $ALARM_UNTIL and $ALARM_REASON, set if it wasn't for failed attempts").String()
+	overrideFile    = kingpin.Flag("override-file", "File written by override-code, whose code clears a lockout when typed during it").ExistingFile()
+
+	overrideCmd  = kingpin.Command("override-code", "Generate a new code for admins to clear a lockout at the keypad, writing its hash to a file for --override-file")
+	overridePath = overrideCmd.Arg("file", "File to write the hash to, replacing any earlier code").Required().String()
+)
+
+// newBruteForcePolicy returns the policy given by the --lockout flags, or nil
+// if lockouts are disabled.
+func newBruteForcePolicy() *totpset.BruteForcePolicy {
+	if *lockoutFailures <= 0 {
+		return nil
+	}
+	return &totpset.BruteForcePolicy{
+		Failures:   *lockoutFailures,
+		Window:     *lockoutWindow,
+		Lockout:    *lockoutFirst,
+		MaxLockout: *lockoutMax,
+	}
+}
+
+// loadOverrideCode returns the hash in the --override-file, or nil if none
+// was given.
+func loadOverrideCode() (*totpset.PINHash, error) {
+	if *overrideFile == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(*overrideFile)
+	if err != nil {
+		return nil, err
+	}
+	hash := new(totpset.PINHash)
+	return hash, json.Unmarshal(contents, hash)
+}
+
+// writeOverrideCode generates a new override code, writes its hash and shows
+// the code, which can't be shown again.
+func writeOverrideCode() error {
+	code, hash, err := totpset.NewOverrideCode()
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(hash)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(*overridePath, contents, 0600); err != nil {
+		return err
+	}
+	fmt.Println("Override code, to clear a lockout by typing it at the keypad during one; keep it safe, it can't be shown again:")
+	fmt.Println("  " + code)
+	return nil
+}
+
+// raiseAlarm logs a lockout at error level, and runs the alarm command if
+// there is one, in the background.
+func raiseAlarm(alarm totpset.Alarm) {
+	log15.Error("ALARM: "+alarm.String(), log15.Ctx{"failures": alarm.Failures, "window": alarm.Window, "lockouts": alarm.Lockouts, "until": alarm.Until, "reason": alarm.Reason})
+	if *alarmCommand == "" {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", *alarmCommand)
+	cmd.Env = append(os.Environ(),
+		"ALARM_FAILURES="+strconv.Itoa(alarm.Failures),
+		"ALARM_WINDOW="+alarm.Window.String(),
+		"ALARM_LOCKOUTS="+strconv.Itoa(alarm.Lockouts),
+		"ALARM_UNTIL="+alarm.Until.Format(time.RFC3339),
+		"ALARM_REASON="+alarm.Reason)
+	go func() {
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log15.Error("Alarm command failed", log15.Ctx{"err": err, "output": string(output)})
+		}
+	}()
+}
+
+// clearLockoutOnSignal clears any lockout each time the client gets SIGUSR1,
+// eg. from an admin running `pkill -USR1 totpClient`.
+func clearLockoutOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		totps.ClearLockout()
+		log15.Warn("Lockout cleared by signal")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	pinCmd          = kingpin.Command("pin", "Set the PIN a member must type before each code, or clear it")
+	pinAccountsFile = pinCmd.Arg("accounts", accountsHelp).Required().String()
+	pinName         = pinCmd.Arg("name", "Name of the member").Required().String()
+	pinClear        = pinCmd.Flag("clear", "Remove the member's PIN, so their code alone lets them in").Bool()
+)
+
+// setPIN asks for a member's new PIN twice, and saves its hash.
+func setPIN() error {
+	store, err := openStore(*pinAccountsFile)
+	if err != nil {
+		return err
+	}
+	k, err := store.Get(*pinName)
+	if err != nil {
+		return err
+	}
+	if *pinClear {
+		k.PIN = nil
+		if err = store.Save(k); err != nil {
+			return err
+		}
+		fmt.Println("Cleared the PIN of " + k.Name)
+		return nil
+	}
+	pin, err := readPassphrase("", "New PIN (4 to 8 digits): ")
+	if err != nil {
+		return err
+	}
+	again, err := readPassphrase("", "New PIN again: ")
+	if err != nil {
+		return err
+	}
+	if string(pin) != string(again) {
+		return errors.New("PINs do not match")
+	}
+	if k.PIN, err = totpset.NewPINHash(string(pin)); err != nil {
+		return err
+	}
+	if err = store.Save(k); err != nil {
+		return err
+	}
+	fmt.Println("Set the PIN of " + k.Name + ", to be typed before each code")
+	return nil
+}
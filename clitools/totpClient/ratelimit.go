@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	rateLimiter      = kingpin.Flag("rate-limiter", "How to ignore input after failed authentications: for --rate-limit seconds each time, for --rate-limit seconds doubling with each consecutive failure up to --rate-limit-max, or after --rate-limit-failures in any --rate-limit-window").Default("fixed").Enum("fixed", "exponential", "window")
+	rateLimitMax     = kingpin.Flag("rate-limit-max", "Longest exponential rate limit").Default("5m").Duration()
+	rateLimitFailure = kingpin.Flag("rate-limit-failures", "Failed authentications allowed in each sliding window").Default("10").Int()
+	rateLimitWindow  = kingpin.Flag("rate-limit-window", "Length of the sliding window").Default("1h").Duration()
+)
+
+// newRateLimiter returns the RateLimiter chosen with --rate-limiter.
+func newRateLimiter() totpset.RateLimiter {
+	base := time.Duration(*secondsRateLimit) * time.Second
+	switch *rateLimiter {
+	case "exponential":
+		return totpset.NewExponentialBackoff(base, *rateLimitMax)
+	case "window":
+		return totpset.NewSlidingWindow(*rateLimitFailure, *rateLimitWindow)
+	default:
+		return totpset.NewFixedDelay(base)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	recoveryPrefix = kingpin.Flag("recovery-prefix", "Keys typed before a recovery code; empty to disable recovery codes").Default(totpset.DefaultRecoveryPrefix).String()
+
+	recoveryCmd          = kingpin.Command("recovery-codes", "Give a member new single-use recovery codes, for when they can't use their authenticator app, replacing any they have")
+	recoveryAccountsFile = recoveryCmd.Arg("accounts", accountsHelp).Required().String()
+	recoveryName         = recoveryCmd.Arg("name", "Name of the member").Required().String()
+	recoveryCount        = recoveryCmd.Flag("count", "Number of codes").Default("8").Int()
+)
+
+// errRecoveryMasterKey is returned when giving out recovery codes without a
+// master key to tag them with.
+var errRecoveryMasterKey = errors.New("Recovery codes need a master key to tag them with; give --master-keyfile")
+
+// recoveryCodes generates new recovery codes for a member, saves their hashes
+// and prints the codes, which can't be shown again.
+func recoveryCodes() error {
+	store, err := openStore(*recoveryAccountsFile)
+	if err != nil {
+		return err
+	}
+	k, err := store.Get(*recoveryName)
+	if err != nil {
+		return err
+	}
+	// Tagged with the master key, which the client finds them by.
+	master, err := masterKey()
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		return errRecoveryMasterKey
+	}
+	codes, err := k.GenerateRecoveryCodes(*recoveryCount, master)
+	if err != nil {
+		return err
+	}
+	if err = store.Save(k); err != nil {
+		return err
+	}
+	fmt.Println("Recovery codes for " + k.Name + ", each to be typed once after " + *recoveryPrefix + " if their app is lost.")
+	fmt.Println("Give them to the member to keep somewhere safe; they can't be shown again:")
+	for _, code := range codes {
+		fmt.Println("  " + code)
+	}
+	return nil
+}
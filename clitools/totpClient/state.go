@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	stateFile = kingpin.Flag("state-file", "JSON file the rate limit, lockout and used codes are kept in across restarts; defaults to the accounts file's name with .state.json added, or the bolt database").String()
+)
+
+// stateStore returns the store for the rate limit, lockout and used codes of
+// the accounts in ks, read from the accounts argument fn.
+func stateStore(fn string, ks totpset.KeyStore) totpset.StateStore {
+	if *stateFile != "" {
+		return totpset.NewJSONStateFile(*stateFile)
+	}
+	if bs, ok := ks.(*totpset.BoltStore); ok {
+		return bs
+	}
+	return totpset.NewJSONStateFile(fn + ".state.json")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+// boltPrefix marks an accounts argument naming a bolt database rather than an
+// accounts file, eg. bolt:members.db, for rosters of thousands.
+const boltPrefix = "bolt:"
+
+// errBoltEncrypted is returned for encrypt or rekey given a bolt database,
+// which is never encrypted.
+var errBoltEncrypted = errors.New("Bolt databases can't be encrypted; keep the file safe, or derive secrets with --master-keyfile so none are stored")
+
+// accountsHelp is the help for every command's accounts argument.
+const accountsHelp = "Accounts JSON File, or bolt:PATH for a bolt database"
+
+// openStore returns the store for the accounts argument fn: the bolt database
+// it names, created if need be, or otherwise the accounts file fn.
+func openStore(fn string) (totpset.KeyStore, error) {
+	if strings.HasPrefix(fn, boltPrefix) {
+		return totpset.OpenBoltStore(strings.TrimPrefix(fn, boltPrefix))
+	}
+	return openAccountsFile(fn)
+}
@@ -10,8 +10,9 @@ preferably disabling or remapping invalid keys and, if possible, numlock.
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"context"
+	"errors"
+	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 
@@ -21,61 +22,192 @@ import (
 )
 
 var (
-	accounts         []FormiteAccount
+	store            totpset.KeyStore
 	totps            *totpset.Set
-	accountsFile     = kingpin.Arg("accounts", "Accounts JSON File").Required().ExistingFile()
-	apiKey           = kingpin.Arg("apiKey", "API key for the door service (base64)").Required().String()
+	runCmd           = kingpin.Command("run", "Read codes from the keypad and open the door for valid ones (default)").Default()
+	accountsFile     = runCmd.Arg("accounts", accountsHelp).Required().String()
+	apiKey           = runCmd.Arg("apiKey", "API key for the door service (base64)").Required().String()
 	secondsGranted   = kingpin.Flag("seconds-granted", "Seconds to unlock door for to permit entry on successful authentication").Default("5").Short('s').Int()
 	secondsRateLimit = kingpin.Flag("rate-limit", "Seconds ignore input on a failed authentication").Default("5").Short('r').Int()
 	doorPort         = kingpin.Flag("door-port", "Port the door microservice API listens on").Default("8080").Short('p').Int()
+	allowCodeReuse   = kingpin.Flag("allow-code-reuse", "Accept a code again after it has opened the door, eg. for members sharing an account").Default("false").Bool()
+	memberDigits     = kingpin.Flag("member-number-digits", "Length of the member numbers that may be typed before a code; 0 to disable").Default("0").Int()
+	requireMember    = kingpin.Flag("require-member-number", "Only accept codes typed after the member's number").Default("false").Bool()
+	quotaGrace       = kingpin.Flag("quota-grace", "How soon a member with a visit quota may come back in without using up another visit").Default(totpset.DefaultQuotaGrace.String()).Duration()
+	maxDrift         = kingpin.Flag("max-drift", "Time steps a member's phone clock may be learned to be off by; 0 to disable").Default("4").Int()
+	ambiguity        = kingpin.Flag("ambiguity", "What to do with a code valid for several members: let the first in the accounts file in, reject it, or ask for the next code").Default("first").Enum("first", "reject", "reenter")
 	door             doorapi.Door
 )
 
-func init() {
-	kingpin.Parse()
-	accountsFileContents, err := ioutil.ReadFile(*accountsFile)
+// loadAccounts reads the accounts in fn and builds the TOTP set from them.
+func loadAccounts(fn string) {
+	var err error
+	store, err = openStore(fn)
 	if err != nil {
 		panic(err)
 	}
-	err = json.Unmarshal(accountsFileContents, &accounts)
+	totps, err = totpset.NewSetFromStore(*secondsRateLimit, store)
 	if err != nil {
 		panic(err)
 	}
-	totps = totpset.NewSet(*secondsRateLimit)
 	totps.ValidityCallback = passcodeToTimePolicy
-	for _, account := range accounts {
-		accKey := totpset.NewKey(account.Name, account.Secret)
-		accKey.Metadata["account"] = account
-		totps.Keys = append(totps.Keys, accKey)
+	if totps.MasterKey, err = masterKey(); err != nil {
+		panic(err)
+	}
+	totps.RateLimiter = newRateLimiter()
+	totps.BruteForce = newBruteForcePolicy()
+	totps.AlarmCallback = raiseAlarm
+	if totps.OverrideCode, err = loadOverrideCode(); err != nil {
+		panic(err)
+	}
+	totps.AllowCodeReuse = *allowCodeReuse
+	totps.MemberNumberDigits = *memberDigits
+	totps.RequireMemberNumber = *requireMember
+	totps.RecoveryPrefix = *recoveryPrefix
+	totps.MaxDrift = *maxDrift
+	totps.QuotaGrace = *quotaGrace
+	if *duressLastDigit {
+		totps.DuressTransform = totpset.IncrementLastDigit
+	}
+	totps.LogCallback = func(s string) {
+		log15.Info("While validating: " + s)
+	}
+	totps.Ambiguity, err = totpset.ParseAmbiguityPolicy(*ambiguity)
+	if err != nil {
+		panic(err)
+	}
+	if err = totps.TrackUsage(usageStore(fn, store)); err != nil {
+		panic(err)
+	}
+	for _, k := range totps.Keys() {
+		if k.MemberNumber != "" && len(k.MemberNumber) != *memberDigits {
+			log15.Warn("Member number is the wrong length and can't be used", log15.Ctx{"who": k.Name, "memberNumber": k.MemberNumber, "memberDigits": *memberDigits})
+		}
+	}
+	if totps.RecoveryPrefix != "" {
+		for _, k := range totps.UntaggedRecoveryCodes() {
+			log15.Warn("Recovery codes were given out without a master key and won't be accepted; give the member new ones", log15.Ctx{"who": k.Name})
+		}
 	}
-	door = doorapi.Door{Port: *doorPort, Secret: *apiKey}
 }
 
 func main() {
+	switch kingpin.Parse() {
+	case analyseCmd.FullCommand():
+		analyse()
+	case lastSeenCmd.FullCommand():
+		lastSeen()
+	case encryptCmd.FullCommand():
+		kingpin.FatalIfError(encrypt(), "Error encrypting accounts file")
+	case rekeyCmd.FullCommand():
+		kingpin.FatalIfError(rekey(), "Error changing passphrase")
+	case editCmd.FullCommand():
+		kingpin.FatalIfError(edit(), "Error editing account")
+	case enrollCmd.FullCommand():
+		kingpin.FatalIfError(enroll(), "Error enrolling member")
+	case overrideCmd.FullCommand():
+		kingpin.FatalIfError(writeOverrideCode(), "Error writing override code")
+	case masterKeyCmd.FullCommand():
+		kingpin.FatalIfError(writeMasterKey(), "Error writing master key")
+	case reenrollCmd.FullCommand():
+		kingpin.FatalIfError(reenroll(), "Error re-enrolling member")
+	case recoveryCmd.FullCommand():
+		kingpin.FatalIfError(recoveryCodes(), "Error generating recovery codes")
+	case pinCmd.FullCommand():
+		kingpin.FatalIfError(setPIN(), "Error setting PIN")
+	case guestMintCmd.FullCommand():
+		kingpin.FatalIfError(guestMint(), "Error issuing guest code")
+	case guestListCmd.FullCommand():
+		kingpin.FatalIfError(guestList(), "Error listing guest codes")
+	case guestRevokeCmd.FullCommand():
+		kingpin.FatalIfError(guestRevoke(), "Error revoking guest code")
+	default:
+		run()
+	}
+}
+
+// namesOf returns the names of keys, for logging who a refused code was
+// valid for without logging their secrets.
+func namesOf(keys []*totpset.Key) []string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name
+	}
+	return names
+}
+
+func run() {
+	loadAccounts(*accountsFile)
+	// An unreadable or corrupt state file leaves the keypad locked out,
+	// rather than forgetting the rate limit and used codes; the alarm says
+	// why.
+	if err := totps.TrackState(stateStore(*accountsFile, store)); err != nil {
+		log15.Error("Error loading rate limit state", log15.Ctx{"err": err})
+	}
+	// Pick up members added to or removed from the accounts file as it
+	// changes.
+	go totps.Follow(context.Background(), store)
+	go clearLockoutOnSignal()
+	for _, warning := range totps.Analyse().Warnings(totpset.DefaultThresholds) {
+		log15.Warn(warning, log15.Ctx{"accounts": len(totps.Keys()), "rateLimit": totps.RateLimitDelay()})
+	}
+	door = doorapi.Door{Port: *doorPort, Secret: *apiKey}
 	for {
-		print("Please enter 6-digit code: ")
+		print("Please enter code: ")
 		codeAttempt, err := getKeypadInput()
 		if err != nil {
-			log15.Error("Error getting input", log15.Ctx{"err": err, "attempt": codeAttempt})
+			log15.Error("Error getting input", log15.Ctx{"err": err, "attempt": totps.Redact(codeAttempt)})
 			continue
 		}
-		ok, who, err := totps.Validate(codeAttempt, func(s string) {
-			log15.Info("While validating: " + s)
-		})
-		if err != nil {
-			log15.Error("Error validating code", log15.Ctx{"err": err, "who": who, "ok": ok, "attempt": codeAttempt})
-			continue
+		result, err := totps.ValidateContext(context.Background(), codeAttempt)
+		// Only ever logged redacted, so neither PINs nor recovery codes go
+		// in the logs.
+		shown := totps.Redact(codeAttempt)
+		who := result.Key()
+		var account FormiteAccount
+		if who != nil {
+			account, _ = accountOf(who)
+		}
+		// Raised whether or not the door opens; nothing at the keypad
+		// shows it.
+		if result.Duress {
+			raiseDuress(who, shown)
 		}
-		whoPolicy := who.Metadata["account"].(FormiteAccount).TimePolicy
-		if ok {
-			log15.Info("Code validated and access granted", log15.Ctx{"who": who, "code": codeAttempt, "policy": whoPolicy})
+		if result.Recovery && result.Outcome == totpset.Accepted {
+			log15.Warn("Recovery code used, follow up with the member", log15.Ctx{"who": who.Name, "left": who.RecoveryCodesLeft()})
+		}
+		switch result.Outcome {
+		case totpset.Accepted:
+			log15.Info("Code validated and access granted", log15.Ctx{"who": who.Name, "code": shown, "policy": account.TimePolicy, "offset": result.StepOffset})
 			err = door.InstructDoorToOpenForSeconds(*secondsGranted)
 			if err != nil {
-				log15.Error("Error instructing door to open", log15.Ctx{"who": who, "code": codeAttempt, "policy": whoPolicy, "err": err})
+				log15.Error("Error instructing door to open", log15.Ctx{"who": who.Name, "code": shown, "policy": account.TimePolicy, "err": err})
 			}
-		} else {
-			log15.Info("Code validated but access denied", log15.Ctx{"who": who, "code": codeAttempt, "policy": whoPolicy})
-			continue
+			if result.DriftGrowing {
+				log15.Warn("Member's phone clock is drifting, ask them to correct it", log15.Ctx{"who": who.Name, "email": account.Email, "drift": who.Drift})
+			}
+		case totpset.Inactive:
+			log15.Info("Code validated but membership inactive", log15.Ctx{"who": who.Name, "code": shown, "reason": result.Reason})
+		case totpset.LockoutCleared:
+			println("Lockout cleared.")
+			log15.Warn("Lockout cleared by override code; give admins a new one with override-code, in case it was seen")
+		case totpset.QuotaExhausted:
+			println("No visits left on your pass for now.")
+			log15.Info("Code validated but visit quota used up", log15.Ctx{"who": who.Name, "code": shown, "quota": account.Quota})
+		case totpset.PolicyDenied:
+			log15.Info("Code validated but access denied", log15.Ctx{"who": who.Name, "code": shown, "policy": account.TimePolicy, "reason": result.Reason})
+		default:
+			if errors.Is(err, totpset.ErrReenterCode) {
+				println("That code can't be told apart from another member's, please enter your next one.")
+			}
+			if result.Outcome == totpset.LockedOut {
+				println("Too many failed attempts, the keypad is locked; please contact an admin.")
+			}
+			if result.Outcome == totpset.RateLimited {
+				wait := time.Until(result.RateLimitedUntil).Round(time.Second)
+				println("Too many failed attempts, please wait " + wait.String() + " before trying again.")
+			}
+			log15.Error("Error validating code", log15.Ctx{"err": err, "outcome": result.Outcome, "who": namesOf(result.Keys), "attempt": shown, "until": result.RateLimitedUntil})
 		}
 	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/cathalgarvey/formadoor/totpset"
+)
+
+var (
+	usageFile = kingpin.Flag("usage-file", "JSON file each member's successful and denied entries are counted in; defaults to the accounts file's name with .usage.json added, or the bolt database").String()
+
+	lastSeenCmd          = kingpin.Command("last-seen", "List members by when they last came in, least recently first")
+	lastSeenAccountsFile = lastSeenCmd.Arg("accounts", accountsHelp).Required().String()
+	lastSeenUnusedFor    = lastSeenCmd.Flag("unused-for", "Only list members who haven't come in for this long, eg. 720h").Duration()
+)
+
+// usageStore returns the store for the usage counts of the accounts in ks,
+// read from the accounts argument fn.
+func usageStore(fn string, ks totpset.KeyStore) totpset.UsageStore {
+	if *usageFile != "" {
+		return totpset.NewJSONUsageFile(*usageFile)
+	}
+	if bs, ok := ks.(*totpset.BoltStore); ok {
+		return bs
+	}
+	return totpset.NewJSONUsageFile(fn + ".usage.json")
+}
+
+// lastSeen prints each member's last entry and counts of entries and denials,
+// those who haven't come in for longest first.
+func lastSeen() {
+	loadAccounts(*lastSeenAccountsFile)
+	now := time.Now()
+	fmt.Printf("%-24s %-20s %9s %9s\n", "Name", "Last seen", "Successes", "Denials")
+	for _, u := range totps.UsageByLastUse() {
+		if !u.LastSuccess.IsZero() && now.Sub(u.LastSuccess) < *lastSeenUnusedFor {
+			continue
+		}
+		seen := "never"
+		if !u.LastSuccess.IsZero() {
+			seen = u.LastSuccess.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-24s %-20s %9d %9d\n", u.Name, seen, u.Successes, u.Denials)
+	}
+}
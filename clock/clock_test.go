@@ -0,0 +1,23 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2016, time.April, 8, 23, 59, 30, 0, time.UTC)
+	f := NewFake(start)
+	assert.Equal(t, start, f.Now())
+	f.Advance(time.Minute)
+	assert.Equal(t, time.Date(2016, time.April, 9, 0, 0, 30, 0, time.UTC), f.Now())
+	f.Set(start)
+	assert.Equal(t, start, Now(f))
+}
+
+func TestNow(t *testing.T) {
+	assert.WithinDuration(t, time.Now(), Now(nil), time.Second)
+	assert.WithinDuration(t, time.Now(), Now(Real{}), time.Second)
+}
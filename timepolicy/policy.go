@@ -3,6 +3,8 @@ package timepolicy
 import (
 	"strings"
 	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
 )
 
 // Policy is a set of PolicyBounds, any of which can validate. Overlaps are
@@ -11,10 +13,28 @@ type Policy struct {
 	Bounds []PolicyBound
 }
 
-// ContainsTime checks whether a time is within any contained PolicyBound.
+// ContainsTime checks whether a time is within any contained PolicyBound, by
+// the days and clock times of the local time zone, whatever t's location.
 func (p Policy) ContainsTime(t time.Time) bool {
+	return p.containsTimeIn(t, time.Local)
+}
+
+// ContainsNow checks whether the local time by c, or the system clock if c is
+// nil, is within any contained PolicyBound.
+func (p Policy) ContainsNow(c clock.Clock) bool {
+	return p.containsTimeIn(clock.Now(c), time.Local)
+}
+
+// containsTimeIn is ContainsTime by the days and clock times of loc.
+func (p Policy) containsTimeIn(t time.Time, loc *time.Location) bool {
+	return p.containsWallTime(t.In(loc))
+}
+
+// containsWallTime is ContainsTime by the days and clock times of t's own
+// location.
+func (p Policy) containsWallTime(t time.Time) bool {
 	for _, pb := range p.Bounds {
-		if pb.ContainsTime(t) {
+		if pb.containsWallTime(t) {
 			return true
 		}
 	}
@@ -3,6 +3,8 @@ package timepolicy
 import (
 	"errors"
 	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
 )
 
 var (
@@ -18,12 +20,12 @@ type ClockTime struct {
 	Minute int
 }
 
-func (ct ClockTime) toTimeToday() (time.Time, error) {
+// toTimeOn returns the ClockTime on the day of t, in t's location.
+func (ct ClockTime) toTimeOn(t time.Time) (time.Time, error) {
 	if !ct.isValid() {
 		return time.Time{}, ErrInvalidClockTime
 	}
-	now := time.Now().Local()
-	return time.Date(now.Year(), now.Month(), now.Day(), ct.Hour, ct.Minute, 0, 0, now.Location()), nil
+	return time.Date(t.Year(), t.Month(), t.Day(), ct.Hour, ct.Minute, 0, 0, t.Location()), nil
 }
 
 func (ct ClockTime) isValid() bool {
@@ -60,11 +62,17 @@ func NewPolicyBound(LowerT, UpperT ClockTime, Days ...time.Weekday) (*PolicyBoun
 }
 
 // ContainsTime checks whether a time lies within the PolicyBound, eg. whether
-// the weekdayof this time is a weekday permitted by the policy, and then
-// whether the time of day is valid within the present day.
+// the weekday of this time is a weekday permitted by the policy, and then
+// whether the time of day is valid within that day. Days and clock times are
+// those of the local time zone, whatever t's location.
 func (pb PolicyBound) ContainsTime(t time.Time) bool {
-	tloc := t.Local()
-	td := tloc.Weekday()
+	return pb.containsWallTime(t.Local())
+}
+
+// containsWallTime is ContainsTime by the days and clock times of t's own
+// location.
+func (pb PolicyBound) containsWallTime(t time.Time) bool {
+	td := t.Weekday()
 	for _, day := range pb.Days {
 		if td == day {
 			goto okday
@@ -72,11 +80,11 @@ func (pb PolicyBound) ContainsTime(t time.Time) bool {
 	}
 	return false
 okday: // Yolo
-	tl, err := pb.LowerTime.toTimeToday()
+	tl, err := pb.LowerTime.toTimeOn(t)
 	if err != nil {
 		return false
 	}
-	tu, err := pb.UpperTime.toTimeToday()
+	tu, err := pb.UpperTime.toTimeOn(t)
 	if err != nil {
 		return false
 	}
@@ -88,3 +96,9 @@ okday: // Yolo
 	}
 	return true
 }
+
+// ContainsNow checks whether the local time by c, or the system clock if c is
+// nil, lies within the PolicyBound.
+func (pb PolicyBound) ContainsNow(c clock.Clock) bool {
+	return pb.containsWallTime(clock.Now(c).Local())
+}
@@ -135,11 +135,13 @@ func parseTimeBits(timebits string) (low, high *ClockTime, err error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	lowToday, err := lowBit.toTimeToday()
+	// Compared on a day in UTC, so that no change of clocks gets in the way.
+	var day time.Time
+	lowToday, err := lowBit.toTimeOn(day)
 	if err != nil {
 		return nil, nil, err
 	}
-	highToday, err := highBit.toTimeToday()
+	highToday, err := highBit.toTimeOn(day)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cathalgarvey/formadoor/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,6 +28,79 @@ func TestTimePolicyBoundsParsing(t *testing.T) {
 	invalidDate := time.Date(2016, time.April, 9, 9, 37, 0, 0, time.Local)
 	assert.True(t, testT.ContainsTime(validDate))
 	assert.False(t, testT.ContainsTime(invalidDate))
+	// The same, by the clock.
+	fake := clock.NewFake(validDate)
+	assert.True(t, testT.ContainsNow(fake))
+	fake.Set(invalidDate)
+	assert.False(t, testT.ContainsNow(fake))
+}
+
+func TestPolicyAroundMidnight(t *testing.T) {
+	policy, err := ParsePolicy("[Fri:Fri]00:00->23:59|[Sun:Sun]22:00->23:59")
+	assert.Nil(t, err)
+	fake := clock.NewFake(time.Date(2016, time.April, 7, 23, 59, 59, 0, time.Local))
+	assert.False(t, policy.ContainsNow(fake))
+	fake.Advance(time.Second)
+	assert.True(t, policy.ContainsNow(fake))
+	// The end of the day is the start of its last minute.
+	fake.Set(time.Date(2016, time.April, 8, 23, 59, 0, 0, time.Local))
+	assert.True(t, policy.ContainsNow(fake))
+	fake.Advance(time.Second)
+	assert.False(t, policy.ContainsNow(fake))
+	fake.Set(time.Date(2016, time.April, 9, 0, 0, 0, 0, time.Local))
+	assert.False(t, policy.ContainsNow(fake))
+	fake.Set(time.Date(2016, time.April, 10, 22, 0, 0, 0, time.Local))
+	assert.True(t, policy.ContainsNow(fake))
+	fake.Advance(2 * time.Hour)
+	assert.False(t, policy.ContainsNow(fake))
+}
+
+func TestPolicyWeekdayInLocation(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone data: " + err.Error())
+	}
+	policy, err := ParsePolicy("[Fri:Fri]20:00->23:59")
+	assert.Nil(t, err)
+	// Saturday in UTC, but still Friday evening in New York.
+	saturday := time.Date(2016, time.April, 9, 0, 30, 0, 0, time.UTC)
+	assert.False(t, policy.containsWallTime(saturday))
+	assert.True(t, policy.containsWallTime(saturday.In(newYork)))
+	// ContainsTime goes by the door's time zone, whatever the time's.
+	assert.True(t, policy.containsTimeIn(saturday, newYork))
+	assert.True(t, policy.containsTimeIn(saturday.In(time.FixedZone("CEST", 2*60*60)), newYork))
+	assert.False(t, policy.containsTimeIn(saturday.In(newYork), time.UTC))
+	assert.Equal(t, policy.containsTimeIn(saturday, time.Local), policy.ContainsTime(saturday.In(newYork)))
+	assert.Equal(t, policy.containsTimeIn(saturday, time.Local), policy.ContainsNow(clock.NewFake(saturday)))
+}
+
+func TestPolicyAcrossDST(t *testing.T) {
+	dublin, err := time.LoadLocation("Europe/Dublin")
+	if err != nil {
+		t.Skip("No time zone data: " + err.Error())
+	}
+	policy, err := ParsePolicy("[Sun:Sun]08:00->20:30")
+	assert.Nil(t, err)
+	// Clocks went forward at 01:00 UTC on the 27th of March 2016, and back at
+	// 01:00 UTC on the 30th of October; opening hours are by the wall clock
+	// either way.
+	for _, day := range []int{20, 27} {
+		assert.False(t, policy.containsWallTime(time.Date(2016, time.March, day, 7, 59, 0, 0, dublin)), day)
+		assert.True(t, policy.containsWallTime(time.Date(2016, time.March, day, 8, 0, 0, 0, dublin)), day)
+		assert.True(t, policy.containsWallTime(time.Date(2016, time.March, day, 20, 30, 0, 0, dublin)), day)
+		assert.False(t, policy.containsWallTime(time.Date(2016, time.March, day, 20, 31, 0, 0, dublin)), day)
+	}
+	fake := clock.NewFake(time.Date(2016, time.October, 30, 7, 59, 0, 0, time.UTC))
+	assert.False(t, policy.containsWallTime(fake.Now().In(dublin)))
+	fake.Advance(time.Minute)
+	assert.True(t, policy.containsWallTime(fake.Now().In(dublin)))
+	fake.Set(time.Date(2016, time.October, 30, 20, 31, 0, 0, time.UTC))
+	assert.False(t, policy.containsWallTime(fake.Now().In(dublin)))
+	// Once the clocks have gone forward, 08:00 in Dublin is 07:00 UTC.
+	fake.Set(time.Date(2016, time.March, 27, 7, 0, 0, 0, time.UTC))
+	assert.True(t, policy.containsWallTime(fake.Now().In(dublin)))
+	fake.Advance(-time.Minute)
+	assert.False(t, policy.containsWallTime(fake.Now().In(dublin)))
 }
 
 func TestClockTimeStringParsing(t *testing.T) {
@@ -0,0 +1,53 @@
+package totpset
+
+import "errors"
+
+var (
+	// ErrAmbiguousCode is returned when a code is valid for more than one Key
+	// and the Set's Ambiguity policy is RejectAmbiguous.
+	ErrAmbiguousCode = errors.New("Code is valid for more than one key, rate limiting")
+
+	// ErrReenterCode is returned when a code is valid for more than one Key
+	// and the Set's Ambiguity policy is ReenterAmbiguous.
+	ErrReenterCode = errors.New("Code is valid for more than one key, please enter your next code")
+)
+
+// AmbiguityPolicy decides what Validate does with a code that is valid for
+// more than one Key, in which case it can't tell who entered it.
+type AmbiguityPolicy int
+
+const (
+	// FirstMatch accepts the code for whichever matching Key comes first in
+	// the Set's Keys, logging the others. This is the default.
+	FirstMatch AmbiguityPolicy = iota
+	// RejectAmbiguous refuses the code as if it were invalid. The members
+	// sharing it can still use it, eg. with their member number.
+	RejectAmbiguous
+	// ReenterAmbiguous refuses the code without rate limiting, so that the
+	// member can go straight on to enter their next code (or their member
+	// number and code) instead. The refused code can't be used again.
+	ReenterAmbiguous
+)
+
+// String returns the name used for the policy on the command line.
+func (ap AmbiguityPolicy) String() string {
+	switch ap {
+	case RejectAmbiguous:
+		return "reject"
+	case ReenterAmbiguous:
+		return "reenter"
+	default:
+		return "first"
+	}
+}
+
+// ParseAmbiguityPolicy returns the AmbiguityPolicy named by name, one of
+// "first", "reject" or "reenter".
+func ParseAmbiguityPolicy(name string) (AmbiguityPolicy, error) {
+	for _, ap := range []AmbiguityPolicy{FirstMatch, RejectAmbiguous, ReenterAmbiguous} {
+		if name == ap.String() {
+			return ap, nil
+		}
+	}
+	return FirstMatch, errors.New("Unknown ambiguity policy '" + name + "', must be first, reject or reenter")
+}
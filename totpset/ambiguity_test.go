@@ -0,0 +1,99 @@
+package totpset
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// collidingSet returns a Set of Keys sharing secret1, so that every code is
+// valid for all of them, plus one Key for secret2.
+func collidingSet(policy AmbiguityPolicy) *Set {
+	set := NewSet(0, NewKey("baz", secret1), NewKey("qux", secret2), NewKey("quux", secret1))
+	set.Ambiguity = policy
+	return set
+}
+
+func TestAmbiguityPolicies(t *testing.T) {
+	code, _ := totp.GenerateCode(secret1, time.Now())
+
+	set := collidingSet(FirstMatch)
+	ok, matches, err := set.ValidateMatches(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []*Key{set.Keys()[0], set.Keys()[2]}, matches)
+
+	set = collidingSet(RejectAmbiguous)
+	set.RateLimitDuration = time.Hour
+	ok, key, err := set.Validate(code, nil)
+	assert.Equal(t, ErrAmbiguousCode, err)
+	assert.False(t, ok)
+	assert.Nil(t, key)
+	assert.True(t, set.NoAttemptsUntil.After(time.Now()))
+	// The rejected code isn't spent.
+	set.ResetRateLimit()
+	set.Ambiguity = FirstMatch
+	ok, _, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	set = collidingSet(ReenterAmbiguous)
+	set.RateLimitDuration = time.Hour
+	ok, matches, err = set.ValidateMatches(code, nil)
+	assert.Equal(t, ErrReenterCode, err)
+	assert.False(t, ok)
+	assert.Len(t, matches, 2)
+	assert.False(t, set.NoAttemptsUntil.After(time.Now()))
+	// Unambiguous codes are unaffected.
+	other, _ := totp.GenerateCode(secret2, time.Now())
+	ok, key, err = set.Validate(other, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "qux", key.Name)
+	// The ambiguous code is spent.
+	_, _, err = set.Validate(code, nil)
+	assert.Equal(t, ErrCodeReused, err)
+}
+
+func TestParseAmbiguityPolicy(t *testing.T) {
+	for _, ap := range []AmbiguityPolicy{FirstMatch, RejectAmbiguous, ReenterAmbiguous} {
+		parsed, err := ParseAmbiguityPolicy(ap.String())
+		assert.Nil(t, err)
+		assert.Equal(t, ap, parsed)
+	}
+	_, err := ParseAmbiguityPolicy("random")
+	assert.Error(t, err)
+}
+
+// Run with -race: concurrent attempts with colliding codes must agree on the
+// matches, and exactly one may get in.
+func TestConcurrentCollidingValidation(t *testing.T) {
+	set := collidingSet(FirstMatch)
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, matches, err := set.ValidateMatches(code, nil)
+			if ok {
+				assert.Len(t, matches, 2)
+				assert.Equal(t, "baz", matches[0].Name)
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			} else {
+				assert.Contains(t, []error{ErrCodeReused, ErrRateLimited}, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, accepted)
+}
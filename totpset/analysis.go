@@ -0,0 +1,180 @@
+package totpset
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// DefaultThresholds are the limits beyond which Analysis.Warnings complains.
+var DefaultThresholds = Thresholds{
+	MinTimeToBreak: 30 * 24 * time.Hour,
+	MaxCollision:   0.01,
+}
+
+// Thresholds are the limits for Analysis.Warnings.
+type Thresholds struct {
+	// MinTimeToBreak is the shortest acceptable expected time for a brute
+	// force attack to get in.
+	MinTimeToBreak time.Duration
+	// MaxCollision is the highest acceptable probability of some code being
+	// valid for more than one Key at once.
+	MaxCollision float64
+}
+
+// Analysis estimates how exposed a Set is to brute force attempts, and how
+// likely it is that members' codes collide and confuse the access logs.
+// The estimates treat codes as uniformly random, which is what they are
+// designed to look like to anyone without the secrets.
+type Analysis struct {
+	Keys int
+	// GuessDigits is the code length an attacker does best guessing at, and
+	// AttemptSuccess the probability that one guess of that length is
+	// accepted for some Key.
+	GuessDigits    int
+	AttemptSuccess float64
+	// TimeToBreak is the expected time for continuous guessing to get in,
+	// given that every wrong guess is followed by the Set's rate limit.
+	TimeToBreak time.Duration
+	// Collision is the probability that, at any given moment, some code is
+	// valid for more than one Key.
+	Collision float64
+}
+
+// Analyse estimates the risks for the Set's current Keys and rate limit, as
+// given by RateLimitDelay.
+// Only Keys that are active now are counted, as the others can't let anyone
+// in. If the Set requires member numbers, each guess is only checked against
+// one Key and codes can't collide, so the estimate is for the weakest Key
+// alone. Otherwise, codes are only counted as colliding between Keys that
+// can't both be picked out by their member numbers.
+func (set *Set) Analyse() Analysis {
+	var keys []*Key
+	now := set.now()
+	for _, k := range set.Keys() {
+		if k.CheckActive(now) == nil {
+			keys = append(keys, k)
+		}
+	}
+	duress := set.DuressTransform != nil
+	delay := set.RateLimitDelay()
+	if !set.RequireMemberNumber {
+		return analyse(keys, delay, duress, set.MemberNumberDigits)
+	}
+	weakest := Analysis{Keys: len(keys), TimeToBreak: timeToBreak(0, delay)}
+	for _, k := range keys {
+		if a := analyse([]*Key{k}, delay, duress, 0); a.AttemptSuccess > weakest.AttemptSuccess {
+			weakest.GuessDigits = a.GuessDigits
+			weakest.AttemptSuccess = a.AttemptSuccess
+			weakest.TimeToBreak = a.TimeToBreak
+		}
+	}
+	return weakest
+}
+
+// Analyse estimates the risks for a roster of Keys guarded by the given rate
+// limit. Each Key accepts 2*Skew+1 codes at once if TOTP, LookAhead+1 if HOTP
+// or one if Guest, out of 10^Digits possible codes (or 10^len(Secret) if
+// Guest), and as many again if it has a DuressSecret. A PIN is guessed along
+// with the code it is typed before, so multiplies the possible codes by
+// 10^4, for the shortest PIN.
+func Analyse(keys []*Key, rateLimit time.Duration) Analysis {
+	return analyse(keys, rateLimit, false, 0)
+}
+
+// analyse is Analyse, counting a duress code for every genuine code of each
+// Key if duress is set, as a Set with a DuressTransform accepts. Keys with
+// member numbers of memberDigits aren't counted as colliding with each other,
+// as their members can type their numbers to tell their codes apart.
+func analyse(keys []*Key, rateLimit time.Duration, duress bool, memberDigits int) Analysis {
+	a := Analysis{Keys: len(keys)}
+	// For each code length, the sum of valid codes per Key and of their
+	// squares, for the collision estimate.
+	valid := make(map[int]float64)
+	validSquared := make(map[int]float64)
+	// The same, for Keys with member numbers only.
+	numbered := make(map[int]float64)
+	numberedSquared := make(map[int]float64)
+	// Probability that a guess of each length is rejected by every Key.
+	rejected := make(map[int]float64)
+	for _, k := range keys {
+		digits := k.ValidateOpts().Digits.Length()
+		codes := float64(2*k.ValidateOpts().Skew + 1)
+		if k.Type == HOTP {
+			codes = float64(k.lookAhead() + 1)
+		}
+		if k.Type == Guest {
+			digits, codes = len(k.Secret), 1
+		}
+		if k.PIN != nil {
+			digits += minPINLength
+		}
+		genuine := codes
+		if k.DuressSecret != "" {
+			codes += genuine
+		}
+		if duress {
+			codes += genuine
+		}
+		space := math.Pow10(digits)
+		if _, ok := rejected[digits]; !ok {
+			rejected[digits] = 1
+		}
+		rejected[digits] *= 1 - math.Min(codes/space, 1)
+		valid[digits] += codes
+		validSquared[digits] += codes * codes
+		if memberDigits > 0 && len(k.MemberNumber) == memberDigits {
+			numbered[digits] += codes
+			numberedSquared[digits] += codes * codes
+		}
+	}
+	for digits, r := range rejected {
+		if p := 1 - r; p > a.AttemptSuccess {
+			a.AttemptSuccess = p
+			a.GuessDigits = digits
+		}
+	}
+	a.TimeToBreak = timeToBreak(a.AttemptSuccess, rateLimit)
+	// Two Keys accepting w1 and w2 codes out of a space of s share one with
+	// probability of about w1*w2/s. Summing over every pair of Keys of each
+	// length gives the expected number of shared codes, from which the
+	// chance of at least one follows. Pairs of Keys that both have member
+	// numbers are left out.
+	var shared float64
+	for digits, w := range valid {
+		n := numbered[digits]
+		pairs := (w*w - validSquared[digits]) - (n*n - numberedSquared[digits])
+		shared += pairs / 2 / math.Pow10(digits)
+	}
+	a.Collision = 1 - math.Exp(-shared)
+	return a
+}
+
+// timeToBreak is the expected number of guesses to succeed, 1/p, times the
+// time each wrong guess costs. It saturates rather than overflowing.
+func timeToBreak(p float64, rateLimit time.Duration) time.Duration {
+	if p <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	expected := float64(rateLimit) / p
+	if expected >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(expected)
+}
+
+// Warnings describes each way in which the Analysis exceeds th, or returns
+// nothing if the Set is within its limits.
+func (a Analysis) Warnings(th Thresholds) []string {
+	var warnings []string
+	if a.Keys > 0 && a.TimeToBreak < th.MinTimeToBreak {
+		warnings = append(warnings, "Brute force expected to succeed within "+a.TimeToBreak.String()+
+			" (minimum "+th.MinTimeToBreak.String()+"); use longer codes, less skew or a longer rate limit")
+	}
+	if a.Collision > th.MaxCollision {
+		warnings = append(warnings, "Probability of members sharing a valid code is "+
+			strconv.FormatFloat(a.Collision, 'g', 3, 64)+" (maximum "+
+			strconv.FormatFloat(th.MaxCollision, 'g', 3, 64)+"); access logs may name the wrong member")
+	}
+	return warnings
+}
@@ -0,0 +1,69 @@
+package totpset
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyse(t *testing.T) {
+	a := Analyse([]*Key{NewKey("baz", secret1)}, 5*time.Second)
+	assert.Equal(t, 6, a.GuessDigits)
+	assert.InDelta(t, 3e-6, a.AttemptSuccess, 1e-12)
+	assert.InDelta(t, float64(5*time.Second)/3e-6, float64(a.TimeToBreak), float64(time.Second))
+	assert.Equal(t, 0.0, a.Collision)
+	assert.Len(t, a.Warnings(DefaultThresholds), 1)
+
+	// Two default Keys share one of their 3 codes with probability ~9/10^6.
+	a = Analyse([]*Key{NewKey("baz", secret1), NewKey("qux", secret2)}, 5*time.Second)
+	assert.InDelta(t, 1-(1-3e-6)*(1-3e-6), a.AttemptSuccess, 1e-12)
+	assert.InDelta(t, 9e-6, a.Collision, 1e-9)
+
+	// A lone 6-digit Key among 8-digit ones is still the best target.
+	var keys []*Key
+	for i := 0; i < 100; i++ {
+		k := NewKey("long", secret1)
+		k.Digits = otp.DigitsEight
+		keys = append(keys, k)
+	}
+	a = Analyse(keys, time.Minute)
+	assert.Equal(t, 8, a.GuessDigits)
+	assert.Empty(t, a.Warnings(DefaultThresholds))
+	a = Analyse(append(keys, NewKey("baz", secret1)), time.Minute)
+	assert.Equal(t, 6, a.GuessDigits)
+}
+
+func TestAnalyseLimits(t *testing.T) {
+	a := NewSet(5).Analyse()
+	assert.Equal(t, time.Duration(math.MaxInt64), a.TimeToBreak)
+	assert.Empty(t, a.Warnings(DefaultThresholds))
+	a = NewSet(0, NewKey("baz", secret1)).Analyse()
+	assert.Equal(t, time.Duration(0), a.TimeToBreak)
+}
+
+func TestAnalysePINsAndMemberNumbers(t *testing.T) {
+	// A PIN is four more digits to guess, at least.
+	baz := NewKey("baz", secret1)
+	baz.PIN, _ = NewPINHash("123456")
+	a := Analyse([]*Key{baz}, 5*time.Second)
+	assert.Equal(t, 10, a.GuessDigits)
+	assert.InDelta(t, 3e-10, a.AttemptSuccess, 1e-16)
+	// So Keys with PINs don't collide with Keys without.
+	a = Analyse([]*Key{baz, NewKey("qux", secret2)}, 5*time.Second)
+	assert.Equal(t, 6, a.GuessDigits)
+	assert.Equal(t, 0.0, a.Collision)
+
+	// Keys that can both be told apart by member number don't collide.
+	qux, quux := NewKey("qux", secret2), NewKey("quux", secret1)
+	qux.MemberNumber, quux.MemberNumber = "01", "02"
+	set := NewSet(5, qux, quux)
+	assert.InDelta(t, 9e-6, set.Analyse().Collision, 1e-9)
+	set.MemberNumberDigits = 2
+	assert.Equal(t, 0.0, set.Analyse().Collision)
+	// But either can collide with a Key without one.
+	set.AddKeys(NewKey("corge", secret1))
+	assert.InDelta(t, 18e-6, set.Analyse().Collision, 1e-9)
+}
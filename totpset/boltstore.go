@@ -0,0 +1,252 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keysBucket and usageBucket are the bolt buckets Keys and their Usage are
+// kept in, by Name; stateBucket keeps a Set's State under stateKey.
+var (
+	keysBucket  = []byte("keys")
+	usageBucket = []byte("usage")
+	stateBucket = []byte("state")
+	stateKey    = []byte("state")
+)
+
+// BoltStore keeps Keys in a bolt database, each encoded as by Key.MarshalJSON,
+// and is also a UsageStore for them and a StateStore for the Set using them.
+// Getting or saving one Key doesn't touch the others, so it suits rosters of
+// thousands. The database is only open for the length of each operation, so
+// other processes, such as totpClient's admin commands, can change it while a
+// Set follows it. Secrets are kept as they are; unlike a JSONFileStore, the
+// database can't be encrypted, so keep it safe, or derive secrets from a
+// master key so that none are stored.
+type BoltStore struct {
+	Filename string
+	// PollInterval is how often Watch checks the database for changes;
+	// zero means DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// OpenBoltStore returns a store for the bolt database fn, creating it if it
+// doesn't exist. Each operation waits up to a second for any other process
+// changing the database to finish.
+func OpenBoltStore(fn string) (*BoltStore, error) {
+	bs := &BoltStore{Filename: fn}
+	err := bs.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(keysBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(usageBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// Close does nothing, as the database is closed after each operation; it is
+// kept so a BoltStore can be closed like other stores.
+func (bs *BoltStore) Close() error {
+	return nil
+}
+
+// view runs fn in a read-only transaction, with the database opened for it
+// alone.
+func (bs *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(bs.Filename, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction, with the database opened for
+// it alone.
+func (bs *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(bs.Filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// Load returns every Key in the database, in order of Name.
+func (bs *BoltStore) Load() ([]*Key, error) {
+	var keys []*Key
+	err := bs.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(name, encoded []byte) error {
+			k := new(Key)
+			if err := json.Unmarshal(encoded, k); err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Get returns the Key with the given Name.
+func (bs *BoltStore) Get(name string) (*Key, error) {
+	k := new(Key)
+	err := bs.view(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(keysBucket).Get([]byte(name))
+		if encoded == nil {
+			return ErrKeyNotFound
+		}
+		return json.Unmarshal(encoded, k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Save writes keys to the database, replacing any with the same Names, in a
+// single transaction.
+func (bs *BoltStore) Save(keys ...*Key) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		for _, k := range keys {
+			encoded, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(k.Name), encoded); err != nil {
+				return err
+			}
+		}
+		// Moving the bucket's sequence on tells Watch of the change.
+		_, err := bucket.NextSequence()
+		return err
+	})
+}
+
+// Delete removes the Key with the given Name.
+func (bs *BoltStore) Delete(name string) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		if bucket.Get([]byte(name)) == nil {
+			return ErrKeyNotFound
+		}
+		if err := bucket.Delete([]byte(name)); err != nil {
+			return err
+		}
+		_, err := bucket.NextSequence()
+		return err
+	})
+}
+
+// sequence returns the sequence of the keys bucket, which moves on with each
+// change to the Keys.
+func (bs *BoltStore) sequence() (uint64, error) {
+	var seq uint64
+	err := bs.view(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(keysBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+// Watch checks the database every PollInterval, and reloads it when its Keys
+// have changed, whether through this store or by another process.
+func (bs *BoltStore) Watch(ctx context.Context, changed func(keys []*Key, err error)) error {
+	interval := bs.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, _ := bs.sequence()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		seq, err := bs.sequence()
+		if err != nil {
+			changed(nil, err)
+			continue
+		}
+		if seq == last {
+			continue
+		}
+		last = seq
+		changed(bs.Load())
+	}
+}
+
+// LoadUsage returns the Usage of every Key in the database.
+func (bs *BoltStore) LoadUsage() (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	err := bs.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).ForEach(func(name, encoded []byte) error {
+			var u Usage
+			if err := json.Unmarshal(encoded, &u); err != nil {
+				return err
+			}
+			usage[string(name)] = u
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// SaveUsage records the Usage of the Key with the given Name. Usage changes
+// aren't seen by Watch, as the Keys themselves haven't changed.
+func (bs *BoltStore) SaveUsage(name string, u Usage) error {
+	encoded, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return bs.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).Put([]byte(name), encoded)
+	})
+}
+
+// LoadState returns the State saved in the database, nil if there is none, or
+// ErrStateCorrupt if it can't be read.
+func (bs *BoltStore) LoadState() (*State, error) {
+	var encoded []byte
+	err := bs.view(func(tx *bolt.Tx) error {
+		// Copied, as it is only valid during the transaction.
+		encoded = append([]byte(nil), tx.Bucket(stateBucket).Get(stateKey)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	return decodeState(encoded)
+}
+
+// SaveState replaces the State saved in the database.
+func (bs *BoltStore) SaveState(state State) error {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return bs.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(stateKey, encoded)
+	})
+}
@@ -0,0 +1,124 @@
+package totpset
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DerivationPrefix starts a secret given as a Derivation, eg.
+// "derive:alice:1", rather than the secret itself.
+const DerivationPrefix = "derive:"
+
+var (
+	// ErrDerivationSpec is returned for a derivation that isn't
+	// derive:MEMBER-ID:GENERATION.
+	ErrDerivationSpec = errors.New("Derived secret must be given as derive:MEMBER-ID:GENERATION")
+
+	// ErrNoMasterKey is returned when deriving a secret without a master key.
+	ErrNoMasterKey = errors.New("No master key to derive secrets from")
+)
+
+// derivationSalt keeps secrets derived here apart from anything else derived
+// from the same master key.
+var derivationSalt = []byte("formadoor TOTP secret")
+
+// Derivation identifies a secret derived from a site master key, so that the
+// secret itself needn't be kept with the Key. Re-enrolling a member bumps
+// their Generation, giving them a new secret.
+type Derivation struct {
+	MemberID   string
+	Generation uint
+}
+
+// ParseDerivation reads a Derivation written as by its String method.
+func ParseDerivation(spec string) (*Derivation, error) {
+	if !strings.HasPrefix(spec, DerivationPrefix) {
+		return nil, ErrDerivationSpec
+	}
+	spec = strings.TrimPrefix(spec, DerivationPrefix)
+	// Member IDs may have colons in them, generations can't.
+	split := strings.LastIndex(spec, ":")
+	if split <= 0 {
+		return nil, ErrDerivationSpec
+	}
+	generation, err := strconv.ParseUint(spec[split+1:], 10, 32)
+	if err != nil {
+		return nil, ErrDerivationSpec
+	}
+	return &Derivation{MemberID: spec[:split], Generation: uint(generation)}, nil
+}
+
+// String returns the Derivation as it is given in place of a secret, eg.
+// "derive:alice:1".
+func (d Derivation) String() string {
+	return DerivationPrefix + d.MemberID + ":" + strconv.FormatUint(uint64(d.Generation), 10)
+}
+
+// DeriveSecret returns the secret for d, of DefaultSecretSize bytes, derived
+// from master with HKDF-SHA256. The master key should be at least as long as
+// the secrets, and kept far more carefully than any one of them.
+func DeriveSecret(master []byte, d Derivation) (string, error) {
+	if len(master) == 0 {
+		return "", ErrNoMasterKey
+	}
+	info := d.MemberID + "\x00" + strconv.FormatUint(uint64(d.Generation), 10)
+	secret := make([]byte, DefaultSecretSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, derivationSalt, []byte(info)), secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(secret), nil
+}
+
+// Derive sets the Secret of a Key with a Derivation from master. Keys without
+// one are left as they are.
+func (k *Key) Derive(master []byte) error {
+	if k.Derivation == nil {
+		return nil
+	}
+	secret, err := DeriveSecret(master, *k.Derivation)
+	if err != nil {
+		return err
+	}
+	k.Secret = secret
+	return nil
+}
+
+// Reenroll gives a Key with a Derivation the secret of its next Generation,
+// so codes from its old secret are no longer accepted.
+func (k *Key) Reenroll(master []byte) error {
+	if k.Derivation == nil {
+		return ErrDerivationSpec
+	}
+	next := *k.Derivation
+	next.Generation++
+	secret, err := DeriveSecret(master, next)
+	if err != nil {
+		return err
+	}
+	k.Derivation = &next
+	k.Secret = secret
+	return nil
+}
+
+// deriveSecrets sets the Secrets of Keys with a Derivation from the Set's
+// MasterKey. Keys that can't be derived are left without a Secret, so match
+// no codes.
+func (set *Set) deriveSecrets(keys []*Key) {
+	for _, k := range keys {
+		if k.Derivation == nil {
+			continue
+		}
+		if err := k.Derive(set.MasterKey); err != nil {
+			k.Secret = ""
+			if set.LogCallback != nil {
+				set.LogCallback("Can't derive secret for " + k.Name + ": " + err.Error())
+			}
+		}
+	}
+}
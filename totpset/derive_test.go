@@ -0,0 +1,116 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestParseDerivation(t *testing.T) {
+	d, err := ParseDerivation("derive:lab:alice:3")
+	assert.Nil(t, err)
+	assert.Equal(t, Derivation{MemberID: "lab:alice", Generation: 3}, *d)
+	assert.Equal(t, "derive:lab:alice:3", d.String())
+	for _, spec := range []string{"GEZDGNBVGY3TQOJQ", "derive:alice", "derive::1", "derive:alice:x", "derive:alice:-1"} {
+		_, err = ParseDerivation(spec)
+		assert.Equal(t, ErrDerivationSpec, err, spec)
+	}
+}
+
+func TestDeriveSecret(t *testing.T) {
+	alice1, err := DeriveSecret(testMasterKey, Derivation{MemberID: "alice", Generation: 1})
+	assert.Nil(t, err)
+	again, _ := DeriveSecret(testMasterKey, Derivation{MemberID: "alice", Generation: 1})
+	assert.Equal(t, alice1, again)
+	alice2, _ := DeriveSecret(testMasterKey, Derivation{MemberID: "alice", Generation: 2})
+	bob1, _ := DeriveSecret(testMasterKey, Derivation{MemberID: "bob", Generation: 1})
+	other, _ := DeriveSecret([]byte("another master key, another site"), Derivation{MemberID: "alice", Generation: 1})
+	assert.NotEqual(t, alice1, alice2)
+	assert.NotEqual(t, alice1, bob1)
+	assert.NotEqual(t, alice1, other)
+	_, err = totp.GenerateCode(alice1, time.Now())
+	assert.Nil(t, err)
+	_, err = DeriveSecret(nil, Derivation{MemberID: "alice", Generation: 1})
+	assert.Equal(t, ErrNoMasterKey, err)
+}
+
+func TestDerivedKey(t *testing.T) {
+	alice := NewKey("alice", "derive:alice:1")
+	assert.Equal(t, "", alice.Secret)
+	assert.Equal(t, &Derivation{MemberID: "alice", Generation: 1}, alice.Derivation)
+	// Only the derivation is stored.
+	assert.Nil(t, alice.Derive(testMasterKey))
+	encoded, err := json.Marshal(alice)
+	assert.Nil(t, err)
+	assert.Contains(t, string(encoded), `"secret":"derive:alice:1"`)
+	assert.NotContains(t, string(encoded), alice.Secret)
+	reloaded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, reloaded))
+	assert.Equal(t, alice.Derivation, reloaded.Derivation)
+	assert.Equal(t, "", reloaded.Secret)
+
+	// Re-enrolling moves to the next generation.
+	old := alice.Secret
+	assert.Nil(t, alice.Reenroll(testMasterKey))
+	assert.Equal(t, uint(2), alice.Derivation.Generation)
+	assert.NotEqual(t, old, alice.Secret)
+	assert.Equal(t, ErrDerivationSpec, NewKey("baz", secret1).Reenroll(testMasterKey))
+}
+
+func TestSetDerivesSecrets(t *testing.T) {
+	alice := NewKey("alice", "derive:alice:1")
+	set := NewSet(0, alice, NewKey("baz", secret1))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	secret, _ := DeriveSecret(testMasterKey, *alice.Derivation)
+	code, _ := totp.GenerateCode(secret, fake.Now())
+
+	// Without the master key, alice can't get in, but others can.
+	_, err := set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Contains(t, logged, "Can't derive secret for alice: "+ErrNoMasterKey.Error())
+	bazCode, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err := set.ValidateContext(context.Background(), bazCode)
+	assert.Nil(t, err)
+	assert.Equal(t, "baz", result.Key().Name)
+
+	set.MasterKey = testMasterKey
+	set.Reindex()
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, alice, result.Key())
+
+	// Re-enrolled, the old secret's codes no longer work.
+	assert.Nil(t, alice.Reenroll(testMasterKey))
+	set.Reindex()
+	code, _ = totp.GenerateCode(secret, fake.Now().Add(30*time.Second))
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrInvalidCode, err)
+	code, _ = totp.GenerateCode(alice.Secret, fake.Now().Add(30*time.Second))
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+}
+
+func TestDerivedKeysReloaded(t *testing.T) {
+	set := NewSet(0, NewKey("alice", "derive:alice:1"))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.MasterKey = testMasterKey
+	secret, _ := DeriveSecret(testMasterKey, Derivation{MemberID: "alice", Generation: 1})
+	code, _ := totp.GenerateCode(secret, fake.Now())
+	_, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	// Reloaded from the store, the Key is new but its used codes aren't.
+	set.SetKeys(NewKey("alice", "derive:alice:1"))
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrCodeReused, err)
+}
@@ -0,0 +1,70 @@
+package totpset
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// driftWeight is how much each accepted code moves a Key's Drift towards its
+// offset. Members often type the previous code just after it changes, so a
+// single offset says little; a run of them says their clock is off.
+const driftWeight = 0.25
+
+// driftSteps returns the Key's Drift rounded to whole time steps, the centre
+// of its validation window.
+func (k *Key) driftSteps() int {
+	return int(math.Round(k.Drift))
+}
+
+// learnDrift moves a TOTP Key's Drift towards offset, the time step its
+// accepted code was from the current one, keeping it within MaxDrift. If that
+// moves the centre of the Key's validation window, the Set's index is
+// rebuilt, used codes are kept for as long as the moved window still accepts
+// them, and the Key is handed to CounterCallback to save. It returns true if
+// the centre moved further from the current step, ie. the drift is growing.
+func (set *Set) learnDrift(k *Key, offset int, logCallback func(string)) bool {
+	if set.MaxDrift == 0 || k.Type != TOTP {
+		return false
+	}
+	set.indexLock.Lock()
+	before := k.driftSteps()
+	limit := float64(set.MaxDrift)
+	k.Drift = math.Max(-limit, math.Min(limit, k.Drift+driftWeight*(float64(offset)-k.Drift)))
+	after := k.driftSteps()
+	if before == after {
+		set.indexLock.Unlock()
+		return false
+	}
+	set.index = nil
+	opts := k.ValidateOpts()
+	for used, expires := range set.usedCodes {
+		if used.key != k {
+			continue
+		}
+		if later := stepExpiry(used.step, opts.Period, opts.Skew, after); later.After(expires) {
+			set.usedCodes[used] = later
+		}
+	}
+	saved := k.snapshot()
+	set.indexLock.Unlock()
+	if set.CounterCallback != nil {
+		if err := set.CounterCallback(saved); err != nil {
+			logCallback("Failed to save clock drift for " + k.Name + ": " + err.Error())
+		}
+	}
+	growing := abs(after) > abs(before)
+	if growing {
+		seconds := time.Duration(after) * time.Duration(opts.Period) * time.Second
+		logCallback("Clock generating codes for " + k.Name + " is about " + strconv.Itoa(after) +
+			" time steps (" + seconds.String() + ") off; ask them to correct it")
+	}
+	return growing
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
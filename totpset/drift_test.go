@@ -0,0 +1,84 @@
+package totpset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriftLearning(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	set := NewSet(0, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.AllowCodeReuse = true
+	set.MaxDrift = 2
+	var saved []float64
+	set.CounterCallback = func(k *Key) error {
+		saved = append(saved, k.Drift)
+		return nil
+	}
+	// A slow phone shows codes one or two steps old; only those one step old
+	// get in at first.
+	slow, _ := totp.GenerateCode(secret1, fake.Now().Add(-30*time.Second))
+	slower, _ := totp.GenerateCode(secret1, fake.Now().Add(-60*time.Second))
+	ok, _, _ := set.Validate(slower, nil)
+	assert.False(t, ok)
+	growing := false
+	for i := 0; i < 3; i++ {
+		result, err := set.ValidateContext(context.Background(), slow)
+		assert.Nil(t, err)
+		growing = growing || result.DriftGrowing
+	}
+	assert.True(t, growing)
+	assert.Equal(t, -1, baz.driftSteps())
+	assert.Len(t, saved, 1)
+	// Centred a step back, the window now takes codes two steps old.
+	ok, _, _ = set.Validate(slower, nil)
+	assert.True(t, ok)
+	// But never further than MaxDrift.
+	set.MaxDrift = 1
+	for i := 0; i < 10; i++ {
+		ok, _, _ = set.Validate(slower, nil)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, -1.0, baz.Drift)
+}
+
+func TestDriftLearningDisabled(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	set := NewSet(0, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.AllowCodeReuse = true
+	code, _ := totp.GenerateCode(secret1, fake.Now().Add(-30*time.Second))
+	for i := 0; i < 10; i++ {
+		ok, _, _ := set.Validate(code, nil)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0.0, baz.Drift)
+}
+
+func TestDriftKeepsUsedCodes(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.Drift = -0.4
+	set := NewSet(0, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.MaxDrift = 5
+	code, _ := totp.GenerateCode(secret1, fake.Now().Add(-30*time.Second))
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.True(t, result.DriftGrowing)
+	assert.Equal(t, -1, baz.driftSteps())
+	// The code stays used for as long as the moved window accepts it.
+	for used, expires := range set.usedCodes {
+		assert.Equal(t, stepExpiry(used.step, DefaultPeriod, DefaultSkew, -1), expires)
+	}
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrCodeReused, err)
+}
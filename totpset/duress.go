@@ -0,0 +1,44 @@
+package totpset
+
+// IncrementLastDigit is a Set.DuressTransform that adds one to the last digit
+// of a code, 9 becoming 0, so that a member can signal duress by entering
+// their code with its last digit changed.
+func IncrementLastDigit(code string) string {
+	if code == "" {
+		return code
+	}
+	last := code[len(code)-1]
+	if last < '0' || last > '9' {
+		return code
+	}
+	return code[:len(code)-1] + string('0'+(last-'0'+1)%10)
+}
+
+// duressCodes returns the duress codes standing in for code, a genuine code
+// of the Key: the code given by transform, if set, and the code generated from
+// the Key's DuressSecret, if it has one, by generate.
+func (k *Key) duressCodes(code string, transform func(string) string, generate func(secret string) (string, error)) []string {
+	var codes []string
+	if transform != nil {
+		if duress := transform(code); duress != code {
+			codes = append(codes, duress)
+		}
+	}
+	if k.DuressSecret != "" {
+		if duress, err := generate(k.DuressSecret); err == nil && duress != code {
+			codes = append(codes, duress)
+		}
+	}
+	return codes
+}
+
+// firstDuress returns the first duress code in matches, and false if there
+// are none.
+func firstDuress(matches []indexMatch) (indexMatch, bool) {
+	for _, m := range matches {
+		if m.Duress {
+			return m, true
+		}
+	}
+	return indexMatch{}, false
+}
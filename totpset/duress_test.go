@@ -0,0 +1,138 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementLastDigit(t *testing.T) {
+	assert.Equal(t, "123457", IncrementLastDigit("123456"))
+	assert.Equal(t, "123450", IncrementLastDigit("123459"))
+	assert.Equal(t, "", IncrementLastDigit(""))
+}
+
+func TestDuressSecret(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.DuressSecret = secret2
+	set := NewSet(5, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	code, _ := totp.GenerateCode(secret2, fake.Now())
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.True(t, result.Duress)
+	assert.Equal(t, baz, result.Key())
+	// The genuine code isn't flagged, but has been used up for this step.
+	code, _ = totp.GenerateCode(secret1, fake.Now().Add(-30*time.Second))
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.False(t, result.Duress)
+	// The flag is still raised when entry is refused.
+	set.ValidityCallback = func(*Key, string) (bool, string) { return false, "closed" }
+	code, _ = totp.GenerateCode(secret2, fake.Now().Add(30*time.Second))
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.True(t, errors.Is(err, ErrPolicyDenied))
+	assert.Equal(t, PolicyDenied, result.Outcome)
+	assert.True(t, result.Duress)
+	set.ResetRateLimit()
+	set.ValidityCallback = nil
+	baz.Suspended = true
+	result, _ = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, Inactive, result.Outcome)
+	assert.True(t, result.Duress)
+}
+
+func TestDuressSharesClaim(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.DuressTransform = IncrementLastDigit
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	_, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	// Someone who saw the code can't get in with its duress form, but the
+	// alarm is raised all the same.
+	result, err := set.ValidateContext(context.Background(), IncrementLastDigit(code))
+	assert.Equal(t, ErrCodeReused, err)
+	assert.Equal(t, CodeReused, result.Outcome)
+	assert.True(t, result.Duress)
+	assert.Equal(t, "baz", result.Key().Name)
+	// Nor the other way around, and a replayed genuine code isn't flagged.
+	set = NewSet(0, NewKey("baz", secret1))
+	set.Clock = fake
+	set.DuressTransform = IncrementLastDigit
+	_, err = set.ValidateContext(context.Background(), IncrementLastDigit(code))
+	assert.Nil(t, err)
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrCodeReused, err)
+	assert.False(t, result.Duress)
+	assert.Nil(t, result.Key())
+}
+
+func TestDuressTransform(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1), newHOTPKey("fob", secret2))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.DuressTransform = IncrementLastDigit
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err := set.ValidateContext(context.Background(), IncrementLastDigit(code))
+	assert.Nil(t, err)
+	assert.True(t, result.Duress)
+	assert.Equal(t, "baz", result.Key().Name)
+	// HOTP Keys move their Counter past duress codes too.
+	code, _ = hotp.GenerateCode(secret2, 1)
+	result, err = set.ValidateContext(context.Background(), IncrementLastDigit(code))
+	assert.Nil(t, err)
+	assert.True(t, result.Duress)
+	assert.Equal(t, "fob", result.Key().Name)
+	assert.Equal(t, uint64(2), result.Key().Counter)
+}
+
+func TestGenuineCodeBeatsDuress(t *testing.T) {
+	baz, qux := NewKey("baz", secret1), NewKey("qux", secret2)
+	// qux's duress code is always baz's genuine one.
+	qux.DuressSecret = secret1
+	set := NewSet(0, qux, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.False(t, result.Duress)
+	assert.Equal(t, []*Key{baz, qux}, result.Keys)
+	// And a Key whose duress code matches its own genuine one isn't flagged.
+	set = NewSet(0, NewKey("baz", secret1))
+	set.Clock = fake
+	set.Keys()[0].DuressSecret = secret1
+	set.Reindex()
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.False(t, result.Duress)
+}
+
+func TestDuressJSONAndAnalysis(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.DuressSecret = secret2
+	encoded, err := json.Marshal(baz)
+	assert.Nil(t, err)
+	assert.Contains(t, string(encoded), `"duress secret":"`+secret2+`"`)
+	decoded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, decoded))
+	assert.Equal(t, baz, decoded)
+
+	// Duress codes are more codes to guess.
+	plain := Analyse([]*Key{NewKey("baz", secret1)}, time.Second)
+	assert.InDelta(t, 2*plain.AttemptSuccess, Analyse([]*Key{baz}, time.Second).AttemptSuccess, 1e-9)
+	set := NewSet(1, baz)
+	set.DuressTransform = IncrementLastDigit
+	assert.InDelta(t, 3*plain.AttemptSuccess, set.Analyse().AttemptSuccess, 1e-9)
+}
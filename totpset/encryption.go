@@ -0,0 +1,230 @@
+package totpset
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedFormat identifies an encrypted JSONFileStore file, and is
+// authenticated along with its contents.
+const encryptedFormat = "formadoor encrypted keys v1"
+
+// scrypt parameters for new files. Each file records its own, so these can be
+// raised without breaking old files. Deriving a key takes about a second on a
+// Raspberry Pi, which is paid once per passphrase and file salt.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// The most scrypt work a file may ask for: room to raise N a little, but no
+// more memory than a Pi can spare (128 * N * R bytes, 128MiB at most), so a
+// tampered file can't exhaust it.
+const (
+	maxScryptN = 1 << 17
+	maxScryptR = scryptR
+	maxScryptP = scryptP
+)
+
+var (
+	// ErrPassphraseRequired is returned when reading an encrypted file with
+	// a store that has no passphrase.
+	ErrPassphraseRequired = errors.New("Key file is encrypted, a passphrase is required")
+
+	// ErrNotEncrypted is returned when a store with a passphrase finds a
+	// plain file, which may have been put in place of the encrypted one.
+	ErrNotEncrypted = errors.New("Key file is not encrypted, refusing to use it with a passphrase")
+
+	// ErrEmptyPassphrase is returned when asked to encrypt with no
+	// passphrase.
+	ErrEmptyPassphrase = errors.New("Passphrase can't be empty")
+
+	// ErrDecryptionFailed is returned when an encrypted file can't be
+	// decrypted, either because the passphrase is wrong or because the file
+	// has been tampered with.
+	ErrDecryptionFailed = errors.New("Could not decrypt key file, wrong passphrase or file corrupted")
+)
+
+// encryptedFile is the contents of an encrypted JSONFileStore file: the JSON
+// list of Keys, sealed with AES-256-GCM under a key derived from the
+// passphrase with scrypt.
+type encryptedFile struct {
+	Format     string `json:"format"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// fileKey is a key derived from a passphrase, and the file parameters it was
+// derived with.
+type fileKey struct {
+	salt    []byte
+	n, r, p int
+	aead    cipher.AEAD
+}
+
+// NewEncryptedFileStore returns a store for the Keys in the encrypted file fn,
+// which is created on the first Save if it doesn't exist. The passphrase can
+// be anything, such as the contents of a key file. Keys are only ever
+// decrypted in memory.
+func NewEncryptedFileStore(fn string, passphrase []byte) *JSONFileStore {
+	return &JSONFileStore{Filename: fn, passphrase: passphrase}
+}
+
+// Encrypted reports whether the store's file is encrypted.
+func (js *JSONFileStore) Encrypted() (bool, error) {
+	contents, err := ioutil.ReadFile(js.Filename)
+	if err != nil {
+		return false, err
+	}
+	return isEncrypted(contents), nil
+}
+
+// Encrypt rewrites the store's file encrypted with a new key derived from
+// passphrase, and uses that from then on. The file may be plain, to encrypt
+// it for the first time, or already encrypted with the store's passphrase, to
+// change the passphrase.
+func (js *JSONFileStore) Encrypt(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return ErrEmptyPassphrase
+	}
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	contents, err := ioutil.ReadFile(js.Filename)
+	if err != nil {
+		return err
+	}
+	if isEncrypted(contents) {
+		if contents, err = js.decode(contents); err != nil {
+			return err
+		}
+	}
+	var keys []*Key
+	if err = json.Unmarshal(contents, &keys); err != nil {
+		return err
+	}
+	js.keyLock.Lock()
+	oldPassphrase, oldKey := js.passphrase, js.key
+	js.passphrase, js.key = passphrase, nil
+	js.keyLock.Unlock()
+	if err = js.write(keys); err != nil {
+		js.keyLock.Lock()
+		js.passphrase, js.key = oldPassphrase, oldKey
+		js.keyLock.Unlock()
+	}
+	return err
+}
+
+func isEncrypted(contents []byte) bool {
+	var ef encryptedFile
+	contents = bytes.TrimSpace(contents)
+	return bytes.HasPrefix(contents, []byte("{")) && json.Unmarshal(contents, &ef) == nil && ef.Format == encryptedFormat
+}
+
+// decode returns the JSON list of Keys in the file contents, decrypting them
+// if the store has a passphrase.
+func (js *JSONFileStore) decode(contents []byte) ([]byte, error) {
+	encrypted := isEncrypted(contents)
+	js.keyLock.Lock()
+	hasPassphrase := js.passphrase != nil
+	js.keyLock.Unlock()
+	switch {
+	case encrypted && !hasPassphrase:
+		return nil, ErrPassphraseRequired
+	case !encrypted && hasPassphrase:
+		return nil, ErrNotEncrypted
+	case encrypted:
+		return js.decrypt(contents)
+	default:
+		return contents, nil
+	}
+}
+
+// encode returns the file contents for the JSON list of Keys, encrypting them
+// if the store has a passphrase.
+func (js *JSONFileStore) encode(plain []byte) ([]byte, error) {
+	js.keyLock.Lock()
+	defer js.keyLock.Unlock()
+	if js.passphrase == nil {
+		return plain, nil
+	}
+	if js.key == nil {
+		salt := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		key, err := deriveFileKey(js.passphrase, salt, scryptN, scryptR, scryptP)
+		if err != nil {
+			return nil, err
+		}
+		js.key = key
+	}
+	nonce := make([]byte, js.key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(encryptedFile{
+		Format:     encryptedFormat,
+		Salt:       js.key.salt,
+		N:          js.key.n,
+		R:          js.key.r,
+		P:          js.key.p,
+		Nonce:      nonce,
+		Ciphertext: js.key.aead.Seal(nil, nonce, plain, []byte(encryptedFormat)),
+	}, "", "  ")
+}
+
+// decrypt opens encrypted file contents with the store's passphrase. The key
+// is kept for as long as the file's salt and parameters stay the same.
+func (js *JSONFileStore) decrypt(contents []byte) ([]byte, error) {
+	var ef encryptedFile
+	if err := json.Unmarshal(contents, &ef); err != nil {
+		return nil, err
+	}
+	// Limit the work a corrupted file can ask for.
+	if ef.N > maxScryptN || ef.R > maxScryptR || ef.P > maxScryptP {
+		return nil, ErrDecryptionFailed
+	}
+	js.keyLock.Lock()
+	defer js.keyLock.Unlock()
+	if js.key == nil || !bytes.Equal(js.key.salt, ef.Salt) || js.key.n != ef.N || js.key.r != ef.R || js.key.p != ef.P {
+		key, err := deriveFileKey(js.passphrase, ef.Salt, ef.N, ef.R, ef.P)
+		if err != nil {
+			return nil, err
+		}
+		js.key = key
+	}
+	plain, err := js.key.aead.Open(nil, ef.Nonce, ef.Ciphertext, []byte(encryptedFormat))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plain, nil
+}
+
+func deriveFileKey(passphrase, salt []byte, n, r, p int) (*fileKey, error) {
+	derived, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileKey{salt: salt, n: n, r: r, p: p, aead: aead}, nil
+}
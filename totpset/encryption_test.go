@@ -0,0 +1,78 @@
+package totpset
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "accounts.json")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(accountsFile), 0600))
+
+	store := NewJSONFileStore(fn)
+	assert.Equal(t, ErrEmptyPassphrase, store.Encrypt(nil))
+	assert.Nil(t, store.Encrypt([]byte("correct horse")))
+	encrypted, err := store.Encrypted()
+	assert.Nil(t, err)
+	assert.True(t, encrypted)
+	contents, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(contents, []byte("GEZDGNBVGY3TQOJQ")))
+	assert.False(t, bytes.Contains(contents, []byte("baz@example.com")))
+	// The store keeps working, and writes stay encrypted.
+	assert.Nil(t, store.Save(NewKey("quux", secret2)))
+	contents, err = ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(contents, []byte(secret2)))
+
+	_, err = NewJSONFileStore(fn).Load()
+	assert.Equal(t, ErrPassphraseRequired, err)
+	_, err = NewEncryptedFileStore(fn, []byte("wrong horse")).Load()
+	assert.Equal(t, ErrDecryptionFailed, err)
+	opened := NewEncryptedFileStore(fn, []byte("correct horse"))
+	keys, err := opened.Load()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 4)
+	assert.Equal(t, "baz@example.com", keys[0].Metadata["email"])
+
+	// Changing the passphrase.
+	assert.Nil(t, opened.Encrypt([]byte("battery staple")))
+	_, err = NewEncryptedFileStore(fn, []byte("correct horse")).Load()
+	assert.Equal(t, ErrDecryptionFailed, err)
+	keys, err = NewEncryptedFileStore(fn, []byte("battery staple")).Load()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 4)
+
+	// Tampering is detected.
+	var ef encryptedFile
+	contents, err = ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(contents, &ef))
+	ef.Ciphertext[0] ^= 1
+	contents, err = json.Marshal(ef)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(fn, contents, 0600))
+	_, err = opened.Load()
+	assert.Equal(t, ErrDecryptionFailed, err)
+	// Asking for more scrypt work than a Pi can spare is refused outright.
+	ef.Ciphertext[0] ^= 1
+	ef.R = 32
+	contents, err = json.Marshal(ef)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(fn, contents, 0600))
+	_, err = opened.Load()
+	assert.Equal(t, ErrDecryptionFailed, err)
+	// As is a plain file put in its place.
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(accountsFile), 0600))
+	_, err = opened.Load()
+	assert.Equal(t, ErrNotEncrypted, err)
+}
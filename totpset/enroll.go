@@ -0,0 +1,121 @@
+package totpset
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/pquerna/otp"
+)
+
+// DefaultSecretSize is the number of random bytes in a generated secret, the
+// 160 bits recommended by RFC 4226.
+const DefaultSecretSize = 20
+
+// GenerateSecret returns a new random secret of size bytes, base32 encoded.
+func GenerateSecret(size int) (string, error) {
+	secret := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(secret), nil
+}
+
+// NewRandomKey is NewKey, with a new random secret of DefaultSecretSize
+// bytes. Set any other parameters before showing the Key to its member with
+// URI, WriteQRPNG or WriteQRTerminal.
+func NewRandomKey(Name string) (*Key, error) {
+	secret, err := GenerateSecret(DefaultSecretSize)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(Name, secret), nil
+}
+
+// URI returns the otpauth URI that enrolls this Key in an authenticator app,
+// labelled with issuer and the Key's Name. Digits, period and algorithm are
+// always given, as apps don't agree on their defaults; HOTP Keys give their
+// Counter instead of a period. The format is documented at
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func (k *Key) URI(issuer string) string {
+	v := url.Values{}
+	v.Set("secret", k.Secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", k.Algorithm.String())
+	if k.Type == HOTP {
+		v.Set("digits", k.hotpOpts().Digits.String())
+		v.Set("counter", strconv.FormatUint(k.Counter, 10))
+	} else {
+		opts := k.ValidateOpts()
+		v.Set("digits", opts.Digits.String())
+		v.Set("period", strconv.FormatUint(uint64(opts.Period), 10))
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     k.Type.String(),
+		Path:     "/" + issuer + ":" + k.Name,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// WriteQRPNG writes the Key's URI, as given by URI, to w as a PNG image of a
+// QR code size pixels square.
+func (k *Key) WriteQRPNG(w io.Writer, issuer string, size int) error {
+	key, err := otp.NewKeyFromURL(k.URI(issuer))
+	if err != nil {
+		return err
+	}
+	img, err := key.Image(size, size)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// WriteQRTerminal writes the Key's URI, as given by URI, to w as a QR code
+// drawn with block characters, two rows of modules to a line, for scanning
+// off a terminal. The code is drawn dark on light with a quiet zone around
+// it, which suits terminals with light text on a dark background.
+func (k *Key) WriteQRTerminal(w io.Writer, issuer string) error {
+	code, err := qr.Encode(k.URI(issuer), qr.M, qr.Auto)
+	if err != nil {
+		return err
+	}
+	const quiet = 2
+	bounds := code.Bounds()
+	// dark reports whether the module at x, y is dark; the quiet zone and
+	// anything past the edge are light.
+	dark := func(x, y int) bool {
+		if x < bounds.Min.X || y < bounds.Min.Y || x >= bounds.Max.X || y >= bounds.Max.Y {
+			return false
+		}
+		r, _, _, _ := code.At(x, y).RGBA()
+		return r == 0
+	}
+	var line []rune
+	for y := bounds.Min.Y - quiet; y < bounds.Max.Y+quiet; y += 2 {
+		line = line[:0]
+		for x := bounds.Min.X - quiet; x < bounds.Max.X+quiet; x++ {
+			// Light modules are drawn as blocks, for light-on-dark terminals.
+			switch top, bottom := !dark(x, y), !dark(x, y+1); {
+			case top && bottom:
+				line = append(line, '█')
+			case top:
+				line = append(line, '▀')
+			case bottom:
+				line = append(line, '▄')
+			default:
+				line = append(line, ' ')
+			}
+		}
+		if _, err := io.WriteString(w, string(line)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package totpset
+
+import (
+	"bytes"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRandomKey(t *testing.T) {
+	k, err := NewRandomKey("baz")
+	assert.Nil(t, err)
+	assert.Len(t, k.Secret, 32)
+	other, err := NewRandomKey("qux")
+	assert.Nil(t, err)
+	assert.NotEqual(t, k.Secret, other.Secret)
+	// The secret works.
+	code, err := totp.GenerateCodeCustom(k.Secret, time.Now(), k.ValidateOpts())
+	assert.Nil(t, err)
+	ok, match, err := NewSet(0, k).Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, k, match)
+}
+
+func TestKeyURI(t *testing.T) {
+	k := NewKey("baz", secret1)
+	k.Digits = otp.DigitsEight
+	k.Period = 60
+	key, err := otp.NewKeyFromURL(k.URI("Forma Door"))
+	assert.Nil(t, err)
+	assert.Equal(t, "totp", key.Type())
+	assert.Equal(t, "Forma Door", key.Issuer())
+	assert.Equal(t, "baz", key.AccountName())
+	assert.Equal(t, secret1, key.Secret())
+	u, err := url.Parse(k.URI("Forma Door"))
+	assert.Nil(t, err)
+	assert.Equal(t, "8", u.Query().Get("digits"))
+	assert.Equal(t, "60", u.Query().Get("period"))
+	assert.Equal(t, "SHA1", u.Query().Get("algorithm"))
+
+	k = newHOTPKey("fob", secret2)
+	k.Counter = 42
+	u, err = url.Parse(k.URI("Forma Door"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hotp", u.Host)
+	assert.Equal(t, "42", u.Query().Get("counter"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+	assert.Empty(t, u.Query().Get("period"))
+}
+
+func TestKeyQR(t *testing.T) {
+	k := NewKey("baz", secret1)
+	var buf bytes.Buffer
+	assert.Nil(t, k.WriteQRPNG(&buf, "Forma Door", 256))
+	img, err := png.Decode(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 256, img.Bounds().Dx())
+	assert.Equal(t, 256, img.Bounds().Dy())
+
+	buf.Reset()
+	assert.Nil(t, k.WriteQRTerminal(&buf, "Forma Door"))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	width := len([]rune(lines[0]))
+	// A QR code is at least 21 modules square, plus the quiet zone, at two
+	// rows of modules per line.
+	assert.True(t, width >= 25)
+	assert.Equal(t, (width+1)/2, len(lines))
+	for _, line := range lines {
+		assert.Len(t, []rune(line), width)
+	}
+	// The quiet zone is light all round.
+	assert.Equal(t, strings.Repeat("█", width), lines[0])
+}
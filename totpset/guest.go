@@ -0,0 +1,75 @@
+package totpset
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// DefaultGuestCodeLength is the number of digits in a guest code if no other
+// length is given. It is longer than a TOTP code, as a guest code stays the
+// same for hours rather than seconds.
+const DefaultGuestCodeLength = 8
+
+var (
+	// ErrGuestCodeUsed is returned when a guest code is valid but has already
+	// let someone in.
+	ErrGuestCodeUsed = errors.New("Guest code has already been used, rate limiting")
+
+	// ErrGuestCodeLength is returned by GenerateGuestCode for lengths too
+	// short to be safe or too long to type.
+	ErrGuestCodeLength = errors.New("Guest codes must be between 6 and 16 digits long")
+)
+
+// GenerateGuestCode returns a random code of length digits.
+func GenerateGuestCode(length int) (string, error) {
+	if length < 6 || length > 16 {
+		return "", ErrGuestCodeLength
+	}
+	return randomDigits(length)
+}
+
+// randomDigits returns a string of length random digits.
+func randomDigits(length int) (string, error) {
+	var code strings.Builder
+	for i := 0; i < length; i++ {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code.WriteString(digit.String())
+	}
+	return code.String(), nil
+}
+
+// NewGuestKey returns a Guest Key with a new random code of length digits,
+// which lets one person in before expires and is then used up. issuedBy
+// names who issued it, for the logs.
+func NewGuestKey(Name, issuedBy string, length int, expires time.Time) (*Key, error) {
+	code, err := GenerateGuestCode(length)
+	if err != nil {
+		return nil, err
+	}
+	k := NewKey(Name, code)
+	k.Type = Guest
+	k.IssuedBy = issuedBy
+	k.NotAfter = expires
+	return k, nil
+}
+
+// Used reports whether the Key is a Guest Key that has already let someone
+// in.
+func (k *Key) Used() bool {
+	return k.Type == Guest && k.Counter > 0
+}
+
+// lookupGuests returns the Guest Keys whose code is passcode.
+func (ki *keyIndex) lookupGuests(passcode string) []indexMatch {
+	var matches []indexMatch
+	for _, i := range ki.guests[strings.TrimSpace(passcode)] {
+		matches = append(matches, indexMatch{Key: ki.keys[i], position: i})
+	}
+	return matches
+}
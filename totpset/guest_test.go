@@ -0,0 +1,83 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateGuestCode(t *testing.T) {
+	code, err := GenerateGuestCode(DefaultGuestCodeLength)
+	assert.Nil(t, err)
+	assert.Len(t, code, DefaultGuestCodeLength)
+	assert.Empty(t, strings.Trim(code, "0123456789"))
+	_, err = GenerateGuestCode(4)
+	assert.Equal(t, ErrGuestCodeLength, err)
+}
+
+func TestGuestCodeSingleUse(t *testing.T) {
+	guest, err := NewGuestKey("plumber", "alice", 8, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	set := NewSet(0, NewKey("baz", secret1), guest)
+	var saved []*Key
+	set.CounterCallback = func(k *Key) error {
+		saved = append(saved, k)
+		return nil
+	}
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	result, err := set.ValidateContext(context.Background(), guest.Secret)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.Equal(t, guest, result.Key())
+	assert.True(t, guest.Used())
+	assert.Equal(t, []*Key{guest}, saved)
+	assert.Contains(t, logged, "Guest code used up: plumber, issued by alice")
+	// The second attempt is refused, saying why.
+	result, err = set.ValidateContext(context.Background(), guest.Secret)
+	assert.Equal(t, ErrGuestCodeUsed, err)
+	assert.Equal(t, Inactive, result.Outcome)
+	// As it is once the store's copy is reloaded.
+	encoded, err := json.Marshal(guest)
+	assert.Nil(t, err)
+	reloaded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, reloaded))
+	assert.WithinDuration(t, guest.NotAfter, reloaded.NotAfter, time.Second)
+	assert.Equal(t, "alice", reloaded.IssuedBy)
+	assert.True(t, reloaded.Used())
+	set.SetKeys(reloaded)
+	set.ResetRateLimit()
+	_, err = set.ValidateContext(context.Background(), guest.Secret)
+	assert.Equal(t, ErrGuestCodeUsed, err)
+}
+
+func TestGuestCodeExpiry(t *testing.T) {
+	guest, err := NewGuestKey("visitor", "alice", 8, time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	set := NewSet(0, guest)
+	_, err = set.ValidateContext(context.Background(), guest.Secret)
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.False(t, guest.Used())
+}
+
+func TestGuestCodeWithoutMemberNumber(t *testing.T) {
+	guest, err := NewGuestKey("visitor", "alice", 8, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	baz := NewKey("baz", secret1)
+	baz.MemberNumber = "042"
+	set := NewSet(0, baz, guest)
+	set.MemberNumberDigits = 3
+	set.RequireMemberNumber = true
+	ok, k, err := set.Validate(guest.Secret, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, guest, k)
+	// A single guess has one chance in 10^8, less than baz's 3 in 10^6.
+	a := Analyse([]*Key{guest}, time.Second)
+	assert.Equal(t, 8, a.GuessDigits)
+	assert.InDelta(t, 1e-8, a.AttemptSuccess, 1e-15)
+}
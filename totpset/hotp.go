@@ -0,0 +1,247 @@
+package totpset
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+const (
+	// DefaultLookAhead is how many counters past the expected one are
+	// accepted for HOTP Keys that don't set their own LookAhead, to allow for
+	// button presses that never reached the keypad.
+	DefaultLookAhead = 10
+
+	// ResyncWindow is how many counters past the expected one Resync will
+	// search for a pair of consecutive codes.
+	ResyncWindow = 1000
+)
+
+var (
+	// ErrNotHOTP is returned when resynchronising a Key that isn't counter
+	// based.
+	ErrNotHOTP = errors.New("Key is not a HOTP key, cannot resynchronise")
+
+	// ErrResyncFailed is returned when no pair of consecutive counters within
+	// ResyncWindow produces the codes given to Resync.
+	ErrResyncFailed = errors.New("Codes do not match any consecutive counters, cannot resynchronise")
+)
+
+// KeyType is TOTP (time based), HOTP (counter based) or Guest (single use).
+type KeyType int
+
+const (
+	// TOTP Keys generate a code per Period of time. This is the default.
+	TOTP KeyType = iota
+	// HOTP Keys generate a code per use, such as per button press on a
+	// hardware token, tracked with Key.Counter.
+	HOTP
+	// Guest Keys have a fixed code, their Secret, which lets one person in
+	// before the Key's NotAfter time and is then used up, setting Counter to
+	// one. They have no duress codes.
+	Guest
+)
+
+// String returns "totp" or "hotp", as used in otpauth URIs, or "guest".
+func (kt KeyType) String() string {
+	switch kt {
+	case HOTP:
+		return "hotp"
+	case Guest:
+		return "guest"
+	default:
+		return "totp"
+	}
+}
+
+// ParseKeyType returns the KeyType named by name, "totp", "hotp" or "guest".
+// An empty name gives the default, TOTP.
+func ParseKeyType(name string) (KeyType, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "totp":
+		return TOTP, nil
+	case "hotp":
+		return HOTP, nil
+	case "guest":
+		return Guest, nil
+	default:
+		return TOTP, errors.New("Unknown key type '" + name + "', must be totp, hotp or guest")
+	}
+}
+
+// hotpOpts returns the options to generate this Key's HOTP codes with.
+func (k *Key) hotpOpts() hotp.ValidateOpts {
+	opts := hotp.ValidateOpts{
+		Digits:    k.Digits,
+		Algorithm: k.Algorithm,
+	}
+	if opts.Digits == 0 {
+		opts.Digits = otp.DigitsSix
+	}
+	return opts
+}
+
+func (k *Key) lookAhead() uint {
+	if k.LookAhead == 0 {
+		return DefaultLookAhead
+	}
+	return k.LookAhead
+}
+
+// counterFor returns the counter within Counter and Counter+lookAhead at
+// which this HOTP Key generates passcode, if any.
+func (k *Key) counterFor(passcode string, lookAhead uint) (uint64, bool) {
+	for c := k.Counter; c <= k.Counter+uint64(lookAhead); c++ {
+		if ok, _ := hotp.ValidateCustom(passcode, c, k.Secret, k.hotpOpts()); ok {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// counterIndex indexes the codes within the look-ahead window of each HOTP
+// Key. A Key's codes are recomputed only when its Counter moves.
+type counterIndex struct {
+	keys   []*Key
+	duress func(string) string
+	// Positions in keys of the Keys covered by this index.
+	members []int
+	// Position -> the Counter that position's codes were computed from.
+	counters map[int]uint64
+	// Code -> slot -> counter generating that code.
+	codes map[string]map[slot]uint64
+}
+
+func newCounterIndex(keys []*Key, duress func(string) string) *counterIndex {
+	return &counterIndex{
+		keys:     keys,
+		duress:   duress,
+		counters: make(map[int]uint64),
+		codes:    make(map[string]map[slot]uint64),
+	}
+}
+
+// refresh recomputes the codes of any Keys whose Counter has moved.
+func (ci *counterIndex) refresh() {
+	for _, i := range ci.members {
+		k := ci.keys[i]
+		if counter, ok := ci.counters[i]; ok && counter == k.Counter {
+			continue
+		}
+		for code, slots := range ci.codes {
+			delete(slots, slot{position: i})
+			delete(slots, slot{position: i, duress: true})
+			if len(slots) == 0 {
+				delete(ci.codes, code)
+			}
+		}
+		ci.counters[i] = k.Counter
+		for c := k.Counter; c <= k.Counter+uint64(k.lookAhead()); c++ {
+			code, err := hotp.GenerateCodeCustom(k.Secret, c, k.hotpOpts())
+			if err != nil {
+				break
+			}
+			ci.add(code, slot{position: i}, c)
+			counter := c
+			for _, duress := range k.duressCodes(code, ci.duress, func(secret string) (string, error) {
+				return hotp.GenerateCodeCustom(secret, counter, k.hotpOpts())
+			}) {
+				ci.add(duress, slot{position: i, duress: true}, c)
+			}
+		}
+	}
+}
+
+// add indexes code as generated at counter c for sl, unless an earlier
+// counter already generates it.
+func (ci *counterIndex) add(code string, sl slot, c uint64) {
+	if ci.codes[code] == nil {
+		ci.codes[code] = make(map[slot]uint64)
+	}
+	if earliest, seen := ci.codes[code][sl]; !seen || c < earliest {
+		ci.codes[code][sl] = c
+	}
+}
+
+// lookup returns all HOTP Keys generating passcode within their look-ahead
+// window. The Step of each match is the counter that generated it, and the
+// Offset how far that is past the Key's Counter; Expires is left zero, as a
+// HOTP code can't be replayed once Counter moves past it. As for codeIndex, a
+// duress code is only reported if it isn't also a genuine code for the Key.
+func (ci *counterIndex) lookup(passcode string) []indexMatch {
+	passcode = strings.TrimSpace(passcode)
+	var matches []indexMatch
+	slots := ci.codes[passcode]
+	for sl, c := range slots {
+		if _, genuine := slots[slot{position: sl.position}]; sl.duress && genuine {
+			continue
+		}
+		k := ci.keys[sl.position]
+		matches = append(matches, indexMatch{Key: k, Step: c, Offset: int(c - k.Counter), Duress: sl.duress, position: sl.position})
+	}
+	return matches
+}
+
+// advanceCounters moves the Counter of each HOTP Key in matches past the
+// counter that was used, and uses up each Guest Key, handing the Key to
+// CounterCallback if set.
+func (set *Set) advanceCounters(matches []indexMatch, logCallback func(string)) {
+	for _, m := range matches {
+		if m.Key.Type == TOTP {
+			continue
+		}
+		if err := set.setCounter(m.Key, m.Step+1, true); err != nil {
+			logCallback("Failed to save counter for " + m.Key.Name + ": " + err.Error())
+		}
+	}
+}
+
+// setCounter sets a Key's Counter and saves it with CounterCallback. If
+// forwardOnly is set, a Counter that has already moved further (because of
+// a concurrent attempt) is left alone.
+func (set *Set) setCounter(k *Key, counter uint64, forwardOnly bool) error {
+	set.indexLock.Lock()
+	if forwardOnly && counter <= k.Counter {
+		set.indexLock.Unlock()
+		return nil
+	}
+	k.Counter = counter
+	saved := k.snapshot()
+	set.indexLock.Unlock()
+	if set.CounterCallback != nil {
+		return set.CounterCallback(saved)
+	}
+	return nil
+}
+
+// Resync finds the pair of consecutive counters at which a HOTP Key generates
+// first and then second, searching up to ResyncWindow counters past the
+// current one, and moves the Key's Counter past them. This recovers a token
+// that has been pressed too often to fall within its look-ahead window.
+func (set *Set) Resync(k *Key, first, second string) error {
+	if k.Type != HOTP {
+		return ErrNotHOTP
+	}
+	opts := k.hotpOpts()
+	// Validate may be moving the Counter on at the same time.
+	set.indexLock.Lock()
+	secret, counter := k.Secret, k.Counter
+	set.indexLock.Unlock()
+	previous, err := hotp.GenerateCodeCustom(secret, counter, opts)
+	if err != nil {
+		return err
+	}
+	for c := counter + 1; c <= counter+ResyncWindow; c++ {
+		code, err := hotp.GenerateCodeCustom(secret, c, opts)
+		if err != nil {
+			return err
+		}
+		if previous == strings.TrimSpace(first) && code == strings.TrimSpace(second) {
+			return set.setCounter(k, c+1, true)
+		}
+		previous = code
+	}
+	return ErrResyncFailed
+}
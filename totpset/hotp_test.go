@@ -0,0 +1,84 @@
+package totpset
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pquerna/otp/hotp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHOTPKey(name, secret string) *Key {
+	k := NewKey(name, secret)
+	k.Type = HOTP
+	k.LookAhead = 3
+	return k
+}
+
+func TestHOTPValidation(t *testing.T) {
+	fob := newHOTPKey("fob", secret2)
+	set := NewSet(0, NewKey("baz", secret1), fob)
+	var saved []uint64
+	set.CounterCallback = func(k *Key) error {
+		saved = append(saved, k.Counter)
+		return nil
+	}
+	// Two presses lost, third reaches the keypad.
+	code, _ := hotp.GenerateCode(secret2, 2)
+	ok, match, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, fob, match)
+	assert.EqualValues(t, 3, fob.Counter)
+	assert.Equal(t, []uint64{3}, saved)
+	// Used and skipped codes are no longer valid.
+	for _, c := range []uint64{0, 2} {
+		code, _ = hotp.GenerateCode(secret2, c)
+		ok, _, err = set.Validate(code, nil)
+		assert.False(t, ok)
+		assert.Equal(t, ErrInvalidCode, err)
+	}
+	// Beyond the look-ahead window.
+	code, _ = hotp.GenerateCode(secret2, 7)
+	ok, _, _ = set.Validate(code, nil)
+	assert.False(t, ok)
+}
+
+func TestHOTPResync(t *testing.T) {
+	fob := newHOTPKey("fob", secret2)
+	set := NewSet(0, fob)
+	first, _ := hotp.GenerateCode(secret2, 500)
+	second, _ := hotp.GenerateCode(secret2, 501)
+	assert.Equal(t, ErrResyncFailed, set.Resync(fob, second, first))
+	assert.EqualValues(t, 0, fob.Counter)
+	assert.Nil(t, set.Resync(fob, first, second))
+	assert.EqualValues(t, 502, fob.Counter)
+	code, _ := hotp.GenerateCode(secret2, 502)
+	ok, _, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ErrNotHOTP, set.Resync(NewKey("baz", secret1), first, second))
+}
+
+func TestHOTPResyncConcurrent(t *testing.T) {
+	fob := newHOTPKey("fob", secret2)
+	set := NewSet(0, fob)
+	first, _ := hotp.GenerateCode(secret2, 500)
+	second, _ := hotp.GenerateCode(secret2, 501)
+	var wg sync.WaitGroup
+	for c := uint64(0); c < 3; c++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			set.Resync(fob, first, second)
+		}()
+		go func(c uint64) {
+			defer wg.Done()
+			code, _ := hotp.GenerateCode(secret2, c)
+			set.Validate(code, nil)
+		}(c)
+	}
+	wg.Wait()
+	// Resync only ever moves the Counter on.
+	assert.EqualValues(t, 502, fob.Counter)
+}
@@ -0,0 +1,272 @@
+package totpset
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// keyIndex maps every code that is currently valid for any of a slice of Keys
+// to the Keys that generate it, so that checking a passcode is a map lookup
+// instead of a HMAC per Key. TOTP Keys are grouped by period, skew and drift,
+// as these decide which time steps are valid; each group gets its own
+// codeIndex.
+// HOTP Keys all go in one counterIndex, and Guest Keys in a map of their
+// codes. Each Key's duress codes, if it has any, are indexed alongside its
+// genuine ones.
+type keyIndex struct {
+	keys     []*Key
+	windows  map[window]*codeIndex
+	counters *counterIndex
+	// Guest code -> positions in keys of Guest Keys with that code.
+	guests map[string][]int
+	// Distinct code lengths of Keys with a PIN.
+	pinDigits []int
+	// Member number -> positions in keys of Keys with that number.
+	byMember map[string][]int
+}
+
+// window is the period, skew and drift shared by all Keys in a codeIndex.
+type window struct {
+	period uint
+	skew   uint
+	drift  int
+}
+
+// slot is a position in the indexed Keys, and whether a code there is one of
+// that Key's duress codes.
+type slot struct {
+	position int
+	duress   bool
+}
+
+// newKeyIndex indexes keys. If duress is set, it gives the duress code
+// standing in for each genuine code; see Set.DuressTransform.
+func newKeyIndex(keys []*Key, duress func(string) string) *keyIndex {
+	ki := &keyIndex{
+		keys:     keys,
+		windows:  make(map[window]*codeIndex),
+		counters: newCounterIndex(keys, duress),
+		guests:   make(map[string][]int),
+		byMember: make(map[string][]int),
+	}
+	for i, k := range keys {
+		if k.Secret == "" {
+			// Eg. a Key whose secret couldn't be derived; an empty
+			// secret would still generate codes.
+			continue
+		}
+		if k.PIN != nil && !containsInt(ki.pinDigits, k.codeLength()) {
+			ki.pinDigits = append(ki.pinDigits, k.codeLength())
+		}
+		if k.MemberNumber != "" {
+			ki.byMember[k.MemberNumber] = append(ki.byMember[k.MemberNumber], i)
+		}
+		if k.Type == HOTP {
+			ki.counters.members = append(ki.counters.members, i)
+			continue
+		}
+		if k.Type == Guest {
+			ki.guests[k.Secret] = append(ki.guests[k.Secret], i)
+			continue
+		}
+		opts := k.ValidateOpts()
+		w := window{period: opts.Period, skew: opts.Skew, drift: k.driftSteps()}
+		ci, ok := ki.windows[w]
+		if !ok {
+			ci = newCodeIndex(w, keys, duress)
+			ki.windows[w] = ci
+		}
+		ci.members = append(ci.members, i)
+	}
+	return ki
+}
+
+func containsInt(ns []int, n int) bool {
+	for _, m := range ns {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh brings every codeIndex up to date for time t.
+func (ki *keyIndex) refresh(t time.Time) {
+	for _, ci := range ki.windows {
+		ci.refresh(t)
+	}
+	ki.counters.refresh()
+}
+
+// lookup returns all Keys generating passcode at any indexed step, in the
+// order they appear in the indexed Keys.
+func (ki *keyIndex) lookup(passcode string) []indexMatch {
+	matches := append(ki.counters.lookup(passcode), ki.lookupGuests(passcode)...)
+	for _, ci := range ki.windows {
+		matches = append(matches, ci.lookup(passcode)...)
+	}
+	sort.Sort(byPosition(matches))
+	return matches
+}
+
+// lookupMember returns the Keys with the given member number that generate
+// passcode at any indexed step.
+func (ki *keyIndex) lookupMember(number, passcode string) []indexMatch {
+	var matches []indexMatch
+	for _, m := range ki.lookup(passcode) {
+		for _, i := range ki.byMember[number] {
+			if m.position == i {
+				matches = append(matches, m)
+			}
+		}
+	}
+	return matches
+}
+
+// codeIndex indexes the codes of those Keys sharing a period, skew and drift.
+// Codes for a time step are computed once, when that step first enters the
+// window, and are dropped when it leaves; so when the window rolls over only
+// one new step needs computing. The window is centred drift steps from the
+// current one.
+type codeIndex struct {
+	period uint
+	skew   uint
+	drift  int
+	keys   []*Key
+	duress func(string) string
+	// Positions in keys of the Keys covered by this index.
+	members []int
+	// Time step -> code -> slots of Keys generating that code.
+	steps map[uint64]map[string][]slot
+	// The time step as of the last refresh.
+	current uint64
+}
+
+func newCodeIndex(w window, keys []*Key, duress func(string) string) *codeIndex {
+	return &codeIndex{
+		period: w.period,
+		skew:   w.skew,
+		drift:  w.drift,
+		keys:   keys,
+		duress: duress,
+		steps:  make(map[uint64]map[string][]slot),
+	}
+}
+
+func (ci *codeIndex) step(t time.Time) uint64 {
+	return uint64(math.Floor(float64(t.Unix()) / float64(ci.period)))
+}
+
+// refresh ensures that codes for every step within skew of the step drift
+// steps from t's are indexed, and forgets any others.
+func (ci *codeIndex) refresh(t time.Time) {
+	current := ci.step(t)
+	ci.current = current
+	centre := uint64(int64(current) + int64(ci.drift))
+	lowest, highest := centre-uint64(ci.skew), centre+uint64(ci.skew)
+	for s := range ci.steps {
+		if s < lowest || s > highest {
+			delete(ci.steps, s)
+		}
+	}
+	for s := lowest; s <= highest; s++ {
+		if _, ok := ci.steps[s]; !ok {
+			ci.steps[s] = ci.codesForStep(s)
+		}
+	}
+}
+
+func (ci *codeIndex) codesForStep(step uint64) map[string][]slot {
+	codes := make(map[string][]slot, len(ci.members))
+	// Any time within the step generates the same code; use its start.
+	t := time.Unix(int64(step*uint64(ci.period)), 0)
+	for _, i := range ci.members {
+		k := ci.keys[i]
+		code, err := totp.GenerateCodeCustom(k.Secret, t, k.ValidateOpts())
+		if err != nil {
+			// A Key with a bad secret can never validate anyway.
+			continue
+		}
+		codes[code] = append(codes[code], slot{position: i})
+		for _, duress := range k.duressCodes(code, ci.duress, func(secret string) (string, error) {
+			return totp.GenerateCodeCustom(secret, t, k.ValidateOpts())
+		}) {
+			codes[duress] = append(codes[duress], slot{position: i, duress: true})
+		}
+	}
+	return codes
+}
+
+// indexMatch is a Key that generates a given code, the time step at which it
+// does so, how far that is from the current step, when that step leaves the
+// validity window, and whether the code is one of the Key's duress codes.
+type indexMatch struct {
+	Key      *Key
+	Step     uint64
+	Offset   int
+	Expires  time.Time
+	Duress   bool
+	position int
+	// The PIN typed before the code, for Keys with a PIN.
+	pin string
+}
+
+// byPosition sorts indexMatches into the order their Keys were indexed in,
+// genuine codes before duress codes, so that a code that is genuine for one
+// Key and a duress code for another doesn't raise the alarm.
+type byPosition []indexMatch
+
+func (m byPosition) Len() int      { return len(m) }
+func (m byPosition) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byPosition) Less(i, j int) bool {
+	if m[i].Duress != m[j].Duress {
+		return !m[i].Duress
+	}
+	return m[i].position < m[j].position
+}
+
+// lookup returns all Keys generating passcode at any indexed step. If a Key
+// generates passcode at more than one step, only the earliest is reported;
+// and if it is both a genuine and a duress code for the Key, only the
+// genuine one.
+func (ci *codeIndex) lookup(passcode string) []indexMatch {
+	passcode = strings.TrimSpace(passcode)
+	steps := make(map[slot]uint64)
+	for s, codes := range ci.steps {
+		for _, sl := range codes[passcode] {
+			if earliest, seen := steps[sl]; !seen || s < earliest {
+				steps[sl] = s
+			}
+		}
+	}
+	matches := make([]indexMatch, 0, len(steps))
+	for sl, s := range steps {
+		if _, genuine := steps[slot{position: sl.position}]; sl.duress && genuine {
+			continue
+		}
+		matches = append(matches, indexMatch{
+			Key:      ci.keys[sl.position],
+			Step:     s,
+			Offset:   int(int64(s) - int64(ci.current)),
+			Expires:  ci.expiry(s),
+			Duress:   sl.duress,
+			position: sl.position,
+		})
+	}
+	return matches
+}
+
+// expiry returns the time at which step leaves the validity window.
+func (ci *codeIndex) expiry(step uint64) time.Time {
+	return stepExpiry(step, ci.period, ci.skew, ci.drift)
+}
+
+// stepExpiry returns the time at which step leaves the validity window of a
+// Key with the given period, skew and drift.
+func stepExpiry(step uint64, period, skew uint, drift int) time.Time {
+	return time.Unix((int64(step)+int64(skew)-int64(drift)+1)*int64(period), 0)
+}
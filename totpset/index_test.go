@@ -0,0 +1,153 @@
+package totpset
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeIndexRollover(t *testing.T) {
+	k := NewKey("baz", secret1)
+	ci := newKeyIndex([]*Key{k}, nil).windows[window{period: DefaultPeriod, skew: DefaultSkew}]
+	start := time.Unix(1459999980, 0) // Start of a time step.
+	ci.refresh(start)
+	assert.Len(t, ci.steps, 3)
+	early, _ := totp.GenerateCode(secret1, start.Add(-30*time.Second))
+	later, _ := totp.GenerateCode(secret1, start.Add(60*time.Second))
+	assert.Equal(t, []indexMatch{{Key: k, Step: ci.step(start) - 1, Offset: -1, Expires: start.Add(30 * time.Second)}}, ci.lookup(early))
+	assert.Empty(t, ci.lookup(later))
+	// Two steps on, the early code has left the window and the later code has
+	// entered it.
+	ci.refresh(start.Add(60 * time.Second))
+	assert.Len(t, ci.steps, 3)
+	assert.Empty(t, ci.lookup(early))
+	assert.Equal(t, []indexMatch{{Key: k, Step: ci.step(start) + 2, Expires: start.Add(120 * time.Second)}}, ci.lookup(later))
+}
+
+func TestIndexFollowsKeys(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	code, _ := totp.GenerateCode(secret2, time.Now())
+	ok, _, _ := set.Validate(code, nil)
+	assert.False(t, ok)
+	set.AddKeys(NewKey("qux", secret2))
+	ok, match, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "qux", match.Name)
+	// Changing a Key in place needs an explicit Reindex.
+	// The previous code, as qux has already used the current step.
+	code, _ = totp.GenerateCode(secret1, time.Now().Add(-30*time.Second))
+	match.Secret = secret1
+	set.Reindex()
+	ok, matches, err := set.ValidateMatches(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, set.Keys(), matches)
+}
+
+func TestMixedKeyParameters(t *testing.T) {
+	noSkew := uint(0)
+	long := NewKey("long", secret1)
+	long.Digits = otp.DigitsEight
+	long.Algorithm = otp.AlgorithmSHA256
+	long.Period = 60
+	strict := NewKey("strict", secret2)
+	strict.Skew = &noSkew
+	set := NewSet(0, NewKey("baz", secret1), long, strict)
+	assert.Len(t, newKeyIndex(set.Keys(), nil).windows, 3)
+	now := time.Now()
+	code, _ := totp.GenerateCodeCustom(secret1, now, long.ValidateOpts())
+	assert.Len(t, code, 8)
+	ok, match, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "long", match.Name)
+	// The same secret with default parameters still works for the old Key.
+	code, _ = totp.GenerateCode(secret1, now)
+	ok, match, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "baz", match.Name)
+	// A code from the previous period is accepted only where there's skew.
+	code, _ = totp.GenerateCode(secret2, now.Add(-30*time.Second))
+	matches := set.matchingKeys(code, now)
+	assert.Empty(t, matches)
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for name, expected := range map[string]otp.Algorithm{
+		"":        otp.AlgorithmSHA1,
+		"sha1":    otp.AlgorithmSHA1,
+		"SHA256":  otp.AlgorithmSHA256,
+		" sha512": otp.AlgorithmSHA512,
+		"MD5":     otp.AlgorithmMD5,
+	} {
+		alg, err := ParseAlgorithm(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, alg)
+	}
+	_, err := ParseAlgorithm("SHA3")
+	assert.Equal(t, ErrUnknownAlgorithm, err)
+}
+
+func benchmarkKeys(n int) []*Key {
+	keys := make([]*Key, n)
+	for i := range keys {
+		secret, _ := totp.Generate(totp.GenerateOpts{
+			Issuer:      "foo.bar",
+			AccountName: strconv.Itoa(i) + "@foo.bar",
+		})
+		keys[i] = NewKey(strconv.Itoa(i), secret.Secret())
+	}
+	return keys
+}
+
+// fanOutMatch is how Set.Validate used to find a Key: one goroutine running
+// totp.Validate per Key.
+func fanOutMatch(keys []*Key, passcode string) *Key {
+	wg := new(sync.WaitGroup)
+	c := make(chan *Key, len(keys))
+	for _, k := range keys {
+		wg.Add(1)
+		go func(k *Key) {
+			defer wg.Done()
+			if totp.Validate(passcode, k.Secret) {
+				c <- k
+			}
+		}(k)
+	}
+	wg.Wait()
+	close(c)
+	return <-c
+}
+
+func benchmarkFanOut(b *testing.B, n int) {
+	keys := benchmarkKeys(n)
+	code, _ := totp.GenerateCode(keys[n-1].Secret, time.Now())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fanOutMatch(keys, code)
+	}
+}
+
+func benchmarkIndex(b *testing.B, n int) {
+	set := NewSet(0, benchmarkKeys(n)...)
+	code, _ := totp.GenerateCode(set.Keys()[n-1].Secret, time.Now())
+	set.matchingKeys(code, time.Now())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.matchingKeys(code, time.Now())
+	}
+}
+
+func BenchmarkFanOut10(b *testing.B)  { benchmarkFanOut(b, 10) }
+func BenchmarkFanOut1k(b *testing.B)  { benchmarkFanOut(b, 1000) }
+func BenchmarkFanOut10k(b *testing.B) { benchmarkFanOut(b, 10000) }
+func BenchmarkIndex10(b *testing.B)   { benchmarkIndex(b, 10) }
+func BenchmarkIndex1k(b *testing.B)   { benchmarkIndex(b, 1000) }
+func BenchmarkIndex10k(b *testing.B)  { benchmarkIndex(b, 10000) }
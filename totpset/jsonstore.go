@@ -0,0 +1,163 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONFileStore keeps Keys in a file holding a JSON list of them, as encoded
+// by Key.MarshalJSON. This is the format of totpClient's accounts file, which
+// is meant to be edited by hand, so it suits small rosters best. The file may
+// also be encrypted; see NewEncryptedFileStore.
+type JSONFileStore struct {
+	Filename string
+	// PollInterval is how often Watch checks the file for changes; zero
+	// means DefaultPollInterval.
+	PollInterval time.Duration
+	// Serialises changes made through this store.
+	lock sync.Mutex
+	// If set, the file is encrypted with a key derived from passphrase.
+	passphrase []byte
+	key        *fileKey
+	keyLock    sync.Mutex
+}
+
+// NewJSONFileStore returns a store for the Keys in the file fn, which is
+// created on the first Save if it doesn't exist.
+func NewJSONFileStore(fn string) *JSONFileStore {
+	return &JSONFileStore{Filename: fn}
+}
+
+// Load returns every Key in the file.
+func (js *JSONFileStore) Load() ([]*Key, error) {
+	contents, err := ioutil.ReadFile(js.Filename)
+	if err != nil {
+		return nil, err
+	}
+	contents, err = js.decode(contents)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	err = json.Unmarshal(contents, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Get returns the first Key in the file with the given Name.
+func (js *JSONFileStore) Get(name string) (*Key, error) {
+	keys, err := js.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return k, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Save writes keys to the file in place of any Keys with the same Names,
+// appending those that are new.
+func (js *JSONFileStore) Save(keys ...*Key) error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	stored, err := js.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, k := range keys {
+		replaced := false
+		for i, existing := range stored {
+			if existing.Name == k.Name {
+				stored[i] = k
+				replaced = true
+			}
+		}
+		if !replaced {
+			stored = append(stored, k)
+		}
+	}
+	return js.write(stored)
+}
+
+// Delete removes every Key in the file with the given Name.
+func (js *JSONFileStore) Delete(name string) error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	stored, err := js.Load()
+	if err != nil {
+		return err
+	}
+	kept := make([]*Key, 0, len(stored))
+	for _, k := range stored {
+		if k.Name != name {
+			kept = append(kept, k)
+		}
+	}
+	if len(kept) == len(stored) {
+		return ErrKeyNotFound
+	}
+	return js.write(kept)
+}
+
+// write replaces the file with keys in one step, so a power cut can't leave
+// it half written.
+func (js *JSONFileStore) write(keys []*Key) error {
+	if keys == nil {
+		keys = []*Key{}
+	}
+	contents, err := marshalReadable(keys, "  ")
+	if err != nil {
+		return err
+	}
+	contents, err = js.encode(contents)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(js.Filename+".tmp", contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(js.Filename+".tmp", js.Filename)
+}
+
+// Watch checks the file every PollInterval, and reloads it when its size or
+// modification time changes, whether it was changed through this store or by
+// anything else.
+func (js *JSONFileStore) Watch(ctx context.Context, changed func(keys []*Key, err error)) error {
+	interval := js.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, _ := os.Stat(js.Filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		info, err := os.Stat(js.Filename)
+		if err == nil && last != nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+		if err != nil && last == nil {
+			continue
+		}
+		last = info
+		if err != nil {
+			changed(nil, err)
+			continue
+		}
+		changed(js.Load())
+	}
+}
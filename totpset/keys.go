@@ -0,0 +1,121 @@
+package totpset
+
+// Keys returns the Set's Keys, in the order codes are checked against them.
+// The slice is a copy, so changing it doesn't change the Set.
+func (set *Set) Keys() []*Key {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	return append([]*Key(nil), set.keys...)
+}
+
+// AddKeys adds keys to the end of the Set. Codes for them are accepted from
+// the next attempt on.
+func (set *Set) AddKeys(keys ...*Key) {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	updated := make([]*Key, 0, len(set.keys)+len(keys))
+	updated = append(updated, set.keys...)
+	set.setKeys(append(updated, keys...))
+}
+
+// RemoveKey removes k from the Set, returning false if it wasn't there. No
+// attempt that hasn't yet been accepted is let in with k after this returns,
+// even if it was already being validated.
+func (set *Set) RemoveKey(k *Key) bool {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	updated := make([]*Key, 0, len(set.keys))
+	for _, existing := range set.keys {
+		if existing != k {
+			updated = append(updated, existing)
+		}
+	}
+	if len(updated) == len(set.keys) {
+		return false
+	}
+	set.setKeys(updated)
+	return true
+}
+
+// ReplaceKey puts replacement in the place of old, returning false if old
+// isn't in the Set. Codes already used with old stay used with replacement,
+// so changing a member's details doesn't let their last code be replayed.
+func (set *Set) ReplaceKey(old, replacement *Key) bool {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	updated := make([]*Key, len(set.keys))
+	copy(updated, set.keys)
+	for i, existing := range updated {
+		if existing == old {
+			updated[i] = replacement
+			set.moveUsed(old, replacement)
+			set.setKeys(updated)
+			return true
+		}
+	}
+	return false
+}
+
+// SetKeys replaces all of the Set's Keys, eg. when the roster is reloaded.
+// Codes already used with a Key stay used with any new Key of the same Name
+// and Secret.
+func (set *Set) SetKeys(keys ...*Key) {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	// Derived first, so their Secrets can be compared.
+	set.deriveSecrets(keys)
+	for _, old := range set.keys {
+		for _, k := range keys {
+			if k != old && k.Name == old.Name && k.Secret == old.Secret {
+				set.moveUsed(old, k)
+				break
+			}
+		}
+	}
+	set.setKeys(append([]*Key(nil), keys...))
+}
+
+// hasKey reports whether k is currently in the Set.
+func (set *Set) hasKey(k *Key) bool {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	for _, existing := range set.keys {
+		if existing == k {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeys installs a new slice of Keys and forgets the used codes of any Keys
+// that are gone. The Keys slice is never modified once installed, only
+// replaced, so the index built from it stays consistent. The caller must hold
+// indexLock.
+func (set *Set) setKeys(keys []*Key) {
+	kept := make(map[*Key]bool, len(keys))
+	for _, k := range keys {
+		kept[k] = true
+	}
+	for used := range set.usedCodes {
+		if !kept[used.key] {
+			delete(set.usedCodes, used)
+		}
+	}
+	set.keys = keys
+	set.index = nil
+	set.pins = countPINs(keys)
+}
+
+// moveUsed transfers the used codes of one Key to another. The caller must
+// hold indexLock.
+func (set *Set) moveUsed(from, to *Key) {
+	if from == to {
+		return
+	}
+	for used, expires := range set.usedCodes {
+		if used.key == from {
+			delete(set.usedCodes, used)
+			set.usedCodes[usedCode{key: to, step: used.step}] = expires
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package totpset
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyMembership(t *testing.T) {
+	baz, qux := NewKey("baz", secret1), NewKey("qux", secret2)
+	set := NewSet(0, baz)
+	set.AddKeys(qux)
+	keys := set.Keys()
+	assert.Equal(t, []*Key{baz, qux}, keys)
+	// The list is a copy.
+	keys[0] = nil
+	assert.Equal(t, baz, set.Keys()[0])
+
+	now := time.Now()
+	code, _ := totp.GenerateCode(secret2, now)
+	assert.True(t, set.RemoveKey(qux))
+	assert.False(t, set.RemoveKey(qux))
+	_, _, err := set.Validate(code, nil)
+	assert.Equal(t, ErrInvalidCode, err)
+
+	// Used codes follow a Key to its replacement.
+	code, _ = totp.GenerateCode(secret1, now)
+	ok, _, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	replacement := NewKey("baz", secret1)
+	assert.True(t, set.ReplaceKey(baz, replacement))
+	assert.False(t, set.ReplaceKey(baz, replacement))
+	_, _, err = set.Validate(code, nil)
+	assert.Equal(t, ErrCodeReused, err)
+	// And to a reloaded Key with the same name and secret, but not another.
+	reloaded := NewKey("baz", secret1)
+	set.SetKeys(reloaded)
+	_, _, err = set.Validate(code, nil)
+	assert.Equal(t, ErrCodeReused, err)
+	set.SetKeys(NewKey("quux", secret1))
+	ok, key, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "quux", key.Name)
+}
+
+func TestRemoveKeyWhileValidating(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	set := NewSet(0, baz)
+	set.ValidityCallback = func(k *Key, _ string) (bool, string) {
+		set.RemoveKey(k)
+		return true, ""
+	}
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	ok, _, err := set.Validate(code, nil)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.False(t, ok)
+	assert.Empty(t, set.Keys())
+}
+
+func TestConcurrentKeyChanges(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	set.AllowCodeReuse = true
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				set.ResetRateLimit()
+				ok, key, err := set.Validate(code, nil)
+				if ok {
+					assert.Nil(t, err)
+					assert.Equal(t, secret1, key.Secret)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			qux := NewKey("qux", secret2)
+			set.AddKeys(qux)
+			set.ReplaceKey(qux, NewKey("quux", secret1))
+			set.SetKeys(set.Keys()[:1]...)
+			set.Analyse()
+		}
+	}()
+	wg.Wait()
+	assert.Len(t, set.Keys(), 1)
+}
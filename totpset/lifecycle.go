@@ -0,0 +1,88 @@
+package totpset
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrKeySuspended is returned when a code is valid but its Key is
+	// suspended.
+	ErrKeySuspended = errors.New("Key is suspended, rate limiting")
+
+	// ErrKeyNotYetValid is returned when a code is valid but its Key's
+	// NotBefore date hasn't come yet.
+	ErrKeyNotYetValid = errors.New("Key is not valid yet, rate limiting")
+
+	// ErrKeyExpired is returned when a code is valid but its Key's NotAfter
+	// date has passed.
+	ErrKeyExpired = errors.New("Key has expired, rate limiting")
+)
+
+// CheckActive returns nil if the Key can let anyone in at t, or else
+// ErrKeySuspended, ErrGuestCodeUsed, ErrKeyNotYetValid or ErrKeyExpired.
+func (k *Key) CheckActive(t time.Time) error {
+	switch {
+	case k.Suspended:
+		return ErrKeySuspended
+	case k.Used():
+		return ErrGuestCodeUsed
+	case !k.NotBefore.IsZero() && t.Before(k.NotBefore):
+		return ErrKeyNotYetValid
+	case !k.NotAfter.IsZero() && t.After(k.NotAfter):
+		return ErrKeyExpired
+	default:
+		return nil
+	}
+}
+
+// partitionActive splits matches into those whose Keys are active at t and
+// those whose Keys aren't.
+func partitionActive(matches []indexMatch, t time.Time) (active, inactive []indexMatch) {
+	for _, m := range matches {
+		if m.Key.CheckActive(t) == nil {
+			active = append(active, m)
+		} else {
+			inactive = append(inactive, m)
+		}
+	}
+	return active, inactive
+}
+
+// dateFormat is how NotBefore and NotAfter dates are written when they fall
+// at the start or end of a day, which is usual for hand-written dates.
+const dateFormat = "2006-01-02"
+
+// parseDate reads a time written as by formatDate. A date alone means the
+// start of that day in local time, or the end of it if endOfDay is set, so
+// that a membership ending on a date includes that day. An empty string gives
+// the zero time.
+func parseDate(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(dateFormat, s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid date '" + s + "', must be YYYY-MM-DD or RFC 3339")
+	}
+	return t, nil
+}
+
+// formatDate writes t as a date alone if that is how parseDate would read it,
+// or else in RFC 3339 format. The zero time gives an empty string.
+func formatDate(t time.Time, endOfDay bool) string {
+	if t.IsZero() {
+		return ""
+	}
+	date := t.In(time.Local).Format(dateFormat)
+	if parsed, _ := parseDate(date, endOfDay); parsed.Equal(t) {
+		return date
+	}
+	return t.Format(time.RFC3339Nano)
+}
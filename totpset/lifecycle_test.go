@@ -0,0 +1,111 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckActive(t *testing.T) {
+	now := time.Now()
+	k := NewKey("baz", secret1)
+	assert.Nil(t, k.CheckActive(now))
+	k.NotBefore = now.Add(time.Hour)
+	assert.Equal(t, ErrKeyNotYetValid, k.CheckActive(now))
+	assert.Nil(t, k.CheckActive(now.Add(time.Hour)))
+	k.NotAfter = now.Add(2 * time.Hour)
+	assert.Nil(t, k.CheckActive(now.Add(2*time.Hour)))
+	assert.Equal(t, ErrKeyExpired, k.CheckActive(now.Add(3*time.Hour)))
+	k.Suspended = true
+	assert.Equal(t, ErrKeySuspended, k.CheckActive(now.Add(time.Hour)))
+}
+
+func TestInactiveKeys(t *testing.T) {
+	baz, qux := NewKey("baz", secret1), NewKey("qux", secret2)
+	set := NewSet(5, baz, qux)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	baz.Suspended = true
+	qux.NotAfter = fake.Now().Add(-time.Minute)
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrKeySuspended, err)
+	assert.Equal(t, Inactive, result.Outcome)
+	assert.Equal(t, baz, result.Key())
+	assert.Equal(t, ErrKeySuspended.Error(), result.Reason)
+	assert.True(t, result.RateLimitedUntil.After(fake.Now()))
+	set.ResetRateLimit()
+	code, _ = totp.GenerateCode(secret2, fake.Now())
+	ok, key, err := set.Validate(code, nil)
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.False(t, ok)
+	assert.Equal(t, qux, key)
+	set.ResetRateLimit()
+	// Unsuspended, the same code is accepted.
+	baz.Suspended = false
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	ok, key, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, baz, key)
+	assert.Equal(t, 1, set.Analyse().Keys)
+}
+
+func TestInactiveKeysDontCollide(t *testing.T) {
+	set := collidingSet(RejectAmbiguous)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	baz := set.Keys()[0]
+	baz.NotBefore = fake.Now().Add(time.Hour)
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	ok, key, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "quux", key.Name)
+}
+
+func TestMembershipEndsAtMidnight(t *testing.T) {
+	var k Key
+	assert.Nil(t, json.Unmarshal([]byte(`{"name": "baz", "secret": "`+secret1+`", "not after": "2017-03-31"}`), &k))
+	set := NewSet(5, &k)
+	fake := clock.NewFake(time.Date(2017, 3, 31, 23, 59, 50, 0, time.Local))
+	set.Clock = fake
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	ok, _, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// Twenty seconds later it's the next day, and the membership is over.
+	fake.Advance(20 * time.Second)
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	ok, _, err = set.Validate(code, nil)
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.False(t, ok)
+	assert.Equal(t, 0, set.Analyse().Keys)
+}
+
+func TestKeyDatesJSON(t *testing.T) {
+	var k Key
+	assert.Nil(t, json.Unmarshal([]byte(`{"name": "baz", "secret": "GEZDGNBVGY3TQOJQ",
+		"not before": "2016-04-01", "not after": "2017-03-31", "suspended": true}`), &k))
+	assert.Equal(t, time.Date(2016, 4, 1, 0, 0, 0, 0, time.Local), k.NotBefore)
+	assert.Equal(t, time.Date(2017, 4, 1, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond), k.NotAfter)
+	assert.True(t, k.Suspended)
+	encoded, err := json.Marshal(k)
+	assert.Nil(t, err)
+	assert.Contains(t, string(encoded), `"not before":"2016-04-01","not after":"2017-03-31","suspended":true`)
+	// Times within a day are kept.
+	k.NotAfter = time.Date(2017, 3, 31, 12, 30, 0, 0, time.UTC)
+	encoded, err = json.Marshal(k)
+	assert.Nil(t, err)
+	assert.Contains(t, string(encoded), `"not after":"2017-03-31T12:30:00Z"`)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"name": "baz", "not after": "31/03/2017"}`), &k))
+	// A membership ending on a date includes that day.
+	k = Key{NotAfter: time.Date(2017, 4, 1, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond)}
+	assert.Nil(t, k.CheckActive(time.Date(2017, 3, 31, 23, 0, 0, 0, time.Local)))
+	assert.Equal(t, ErrKeyExpired, k.CheckActive(time.Date(2017, 4, 1, 0, 0, 0, 0, time.Local)))
+}
@@ -0,0 +1,179 @@
+package totpset
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverrideCodeLength is the number of digits in an override code.
+const OverrideCodeLength = 12
+
+var (
+	// ErrLockedOut is returned for attempts made while a Set is locked out
+	// after a suspected brute force attack.
+	ErrLockedOut = errors.New("Locked out after too many failures, ignoring input")
+
+	// ErrLockoutCleared is returned for the Set's override code, which
+	// clears any lockout but lets no one in.
+	ErrLockoutCleared = errors.New("Override code entered, lockout cleared")
+)
+
+// BruteForcePolicy decides when failures look like someone guessing codes,
+// and how long a Set then locks out all attempts for. Each lockout in a row
+// is twice as long as the last, up to MaxLockout; the doubling starts over
+// once MaxLockout has passed since the last lockout ended.
+type BruteForcePolicy struct {
+	// More than Failures within Window set off a lockout.
+	Failures int
+	Window   time.Duration
+	// Lockout is the length of the first lockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// DefaultBruteForcePolicy locks out for a quarter of an hour after more than
+// 20 failures in 10 minutes, far more than members mistyping make, and for up
+// to a day if the failures carry on.
+var DefaultBruteForcePolicy = BruteForcePolicy{
+	Failures:   20,
+	Window:     10 * time.Minute,
+	Lockout:    15 * time.Minute,
+	MaxLockout: 24 * time.Hour,
+}
+
+// Alarm describes a suspected brute force attack, raised by a Set through its
+// AlarmCallback when it locks out.
+type Alarm struct {
+	Time time.Time
+	// Reason, if set, is why the Set locked out other than failures, eg.
+	// losing its State.
+	Reason string
+	// Failures made within the policy's Window that set the lockout off.
+	Failures int
+	Window   time.Duration
+	// Lockouts in a row, this one included, and when this one ends.
+	Lockouts int
+	Until    time.Time
+}
+
+// String describes the Alarm for logs.
+func (a Alarm) String() string {
+	if a.Reason != "" {
+		return a.Reason + ", locked out until " + a.Until.Format(time.RFC3339)
+	}
+	return "Suspected brute force attack: " + strconv.Itoa(a.Failures) + " failures within " + a.Window.String() +
+		", locked out until " + a.Until.Format(time.RFC3339) + " (lockout " + strconv.Itoa(a.Lockouts) + " in a row)"
+}
+
+// lockoutState is what a Set tracks for its BruteForcePolicy, guarded by
+// rateLock.
+type lockoutState struct {
+	// Failures within the policy's Window, oldest first.
+	failures []time.Time
+	lockouts int
+	until    time.Time
+}
+
+// noteFailure records a failed attempt at now against the policy, and
+// returns the Alarm to raise if it sets off a lockout.
+func (ls *lockoutState) noteFailure(policy *BruteForcePolicy, now time.Time) *Alarm {
+	recent := ls.failures[:0]
+	for _, t := range ls.failures {
+		if now.Sub(t) < policy.Window {
+			recent = append(recent, t)
+		}
+	}
+	ls.failures = append(recent, now)
+	if len(ls.failures) <= policy.Failures {
+		return nil
+	}
+	if ls.lockouts > 0 && now.Sub(ls.until) > policy.MaxLockout {
+		ls.lockouts = 0
+	}
+	ls.lockouts++
+	lockout := policy.Lockout
+	for i := 1; i < ls.lockouts && lockout < policy.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > policy.MaxLockout {
+		lockout = policy.MaxLockout
+	}
+	alarm := &Alarm{Time: now, Failures: len(ls.failures), Window: policy.Window, Lockouts: ls.lockouts, Until: now.Add(lockout)}
+	ls.until = alarm.Until
+	ls.failures = nil
+	return alarm
+}
+
+// raiseAlarm passes alarm to the Set's AlarmCallback and LogCallback.
+func (set *Set) raiseAlarm(alarm Alarm) {
+	if set.LogCallback != nil {
+		set.LogCallback(alarm.String())
+	}
+	if set.AlarmCallback != nil {
+		set.AlarmCallback(alarm)
+	}
+}
+
+// LockedOutUntil returns when the Set's current lockout ends, or a time
+// already past if it isn't locked out.
+func (set *Set) LockedOutUntil() time.Time {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	return set.lockout.until
+}
+
+// ClearLockout ends any lockout, forgets the failures counted towards the
+// next, and lifts the rate limit as ResetRateLimit does; eg. once an admin
+// has checked on the door.
+func (set *Set) ClearLockout() {
+	set.rateLock.Lock()
+	set.lockout = lockoutState{}
+	set.rateLock.Unlock()
+	set.ResetRateLimit()
+}
+
+// lockedOut reports whether the Set is locked out at now, and until when.
+func (set *Set) lockedOut(now time.Time) (bool, time.Time) {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	return now.Before(set.lockout.until), set.lockout.until
+}
+
+// NewOverrideCode returns a new random override code, of OverrideCodeLength
+// digits, and its hash to set as a Set's OverrideCode.
+func NewOverrideCode() (string, *PINHash, error) {
+	code, err := randomDigits(OverrideCodeLength)
+	if err != nil {
+		return "", nil, err
+	}
+	salt, hash, err := newHash(code)
+	if err != nil {
+		return "", nil, err
+	}
+	return code, &PINHash{Salt: salt, Hash: hash}, nil
+}
+
+// isOverrideCode reports whether passcode is the Set's OverrideCode. Only
+// passcodes of its length are hashed.
+func (set *Set) isOverrideCode(passcode string) bool {
+	passcode = strings.TrimSpace(passcode)
+	return set.OverrideCode != nil && len(passcode) == OverrideCodeLength && set.OverrideCode.Matches(passcode)
+}
+
+// validateOverride handles the Set's override code, which clears any lockout
+// and rate limit but lets no one in.
+func (set *Set) validateOverride(logCallback func(string)) (ValidationResult, error) {
+	set.ClearLockout()
+	logCallback("Override code entered, lockout cleared.")
+	return ValidationResult{Outcome: LockoutCleared}, ErrLockoutCleared
+}
+
+// validateLockedOut handles any other attempt made while the Set is locked
+// out, which is ignored but counted as a failure, so that guessing at the
+// override code is rate limited and counts towards the next lockout.
+func (set *Set) validateLockedOut(logCallback func(string)) (ValidationResult, error) {
+	logCallback("Locked out, validation aborted.")
+	return ValidationResult{Outcome: LockedOut, RateLimitedUntil: set.rateLimit()}, ErrLockedOut
+}
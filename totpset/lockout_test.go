@@ -0,0 +1,135 @@
+package totpset
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockoutEscalates(t *testing.T) {
+	policy := &BruteForcePolicy{Failures: 2, Window: time.Minute, Lockout: time.Hour, MaxLockout: 3 * time.Hour}
+	var ls lockoutState
+	now := time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC)
+	assert.Nil(t, ls.noteFailure(policy, now))
+	assert.Nil(t, ls.noteFailure(policy, now.Add(30*time.Second)))
+	// The first failure has left the window.
+	assert.Nil(t, ls.noteFailure(policy, now.Add(70*time.Second)))
+	alarm := ls.noteFailure(policy, now.Add(80*time.Second))
+	assert.NotNil(t, alarm)
+	assert.Equal(t, 3, alarm.Failures)
+	assert.Equal(t, 1, alarm.Lockouts)
+	assert.Equal(t, now.Add(80*time.Second+time.Hour), alarm.Until)
+	assert.Contains(t, alarm.String(), "3 failures within 1m0s")
+
+	// Each lockout in a row is longer, up to MaxLockout.
+	now = alarm.Until
+	for _, lockout := range []time.Duration{2 * time.Hour, 3 * time.Hour, 3 * time.Hour} {
+		ls.noteFailure(policy, now)
+		ls.noteFailure(policy, now)
+		alarm = ls.noteFailure(policy, now)
+		assert.Equal(t, now.Add(lockout), alarm.Until)
+		now = alarm.Until
+	}
+	// After a quiet spell, they start over.
+	now = now.Add(4 * time.Hour)
+	ls.noteFailure(policy, now)
+	ls.noteFailure(policy, now)
+	alarm = ls.noteFailure(policy, now)
+	assert.Equal(t, 1, alarm.Lockouts)
+	assert.Equal(t, now.Add(time.Hour), alarm.Until)
+}
+
+func TestSetLockout(t *testing.T) {
+	set := NewSet(5, NewKey("baz", secret1))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.BruteForce = &BruteForcePolicy{Failures: 2, Window: time.Minute, Lockout: time.Hour, MaxLockout: 24 * time.Hour}
+	var alarms []Alarm
+	set.AlarmCallback = func(a Alarm) { alarms = append(alarms, a) }
+	code, hash, err := NewOverrideCode()
+	assert.Nil(t, err)
+	assert.Len(t, code, OverrideCodeLength)
+	set.OverrideCode = hash
+
+	for i := 0; i < 2; i++ {
+		_, err = set.ValidateContext(context.Background(), "000000")
+		assert.Equal(t, ErrInvalidCode, err)
+		fake.Advance(5 * time.Second)
+	}
+	assert.Empty(t, alarms)
+	result, err := set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, fake.Now().Add(time.Hour), result.RateLimitedUntil)
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, fake.Now().Add(time.Hour), set.LockedOutUntil())
+
+	// Even valid codes are ignored for now.
+	fake.Advance(time.Minute)
+	valid, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err = set.ValidateContext(context.Background(), valid)
+	assert.Equal(t, ErrLockedOut, err)
+	assert.Equal(t, LockedOut, result.Outcome)
+	assert.Equal(t, "locked out", result.Outcome.String())
+	assert.Equal(t, set.LockedOutUntil(), result.RateLimitedUntil)
+	// So is the override code, while rate limited like any other.
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrLockedOut, err)
+	assert.Equal(t, set.LockedOutUntil(), result.RateLimitedUntil)
+
+	// Otherwise it clears the lockout, but opens nothing.
+	fake.Advance(5 * time.Second)
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrLockoutCleared, err)
+	assert.Equal(t, LockoutCleared, result.Outcome)
+	assert.Nil(t, result.Key())
+	result, err = set.ValidateContext(context.Background(), valid)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	// It's recognised without a lockout too, so it's never logged.
+	fake.Advance(time.Minute)
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	_, err = set.ValidateContext(context.Background(), " "+code)
+	assert.Equal(t, ErrLockoutCleared, err)
+	assert.Contains(t, logged, "Override code entered, lockout cleared.")
+	for _, line := range logged {
+		assert.NotContains(t, line, code)
+	}
+	assert.Equal(t, strings.Repeat("*", OverrideCodeLength), set.Redact(code))
+	set.LogCallback = nil
+	assert.True(t, set.LockedOutUntil().IsZero())
+
+	// Validate gives no Key along with the error, as callers expect.
+	for i := 0; i < 3; i++ {
+		fake.Advance(5 * time.Second)
+		set.ValidateContext(context.Background(), "000000")
+	}
+	assert.True(t, set.LockedOutUntil().After(fake.Now()))
+	// Guesses at the override code during a lockout count towards the next.
+	assert.Len(t, alarms, 2)
+	for i := 0; i < 3; i++ {
+		fake.Advance(5 * time.Second)
+		_, err = set.ValidateContext(context.Background(), "000000000000")
+		assert.Equal(t, ErrLockedOut, err)
+	}
+	assert.Len(t, alarms, 3)
+	assert.Equal(t, fake.Now().Add(2*time.Hour), set.LockedOutUntil())
+	fake.Advance(5 * time.Second)
+	ok, k, err := set.Validate(code, nil)
+	assert.False(t, ok)
+	assert.Nil(t, k)
+	assert.Equal(t, ErrLockoutCleared, err)
+}
+
+func TestBruteForceDelay(t *testing.T) {
+	set := NewSet(5)
+	assert.Equal(t, 5*time.Second, set.RateLimitDelay())
+	set.BruteForce = &DefaultBruteForcePolicy
+	// 21 guesses a day, near enough.
+	assert.Equal(t, (24*time.Hour+100*time.Second)/21, set.RateLimitDelay())
+}
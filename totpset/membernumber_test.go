@@ -0,0 +1,50 @@
+package totpset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberNumbers(t *testing.T) {
+	// Both Keys share a secret, so their codes always collide.
+	baz := NewKey("baz", secret1)
+	baz.MemberNumber = "041"
+	qux := NewKey("qux", secret1)
+	qux.MemberNumber = "042"
+	set := NewSet(0, baz, qux)
+	set.AllowCodeReuse = true
+	set.MemberNumberDigits = 3
+	code, _ := totp.GenerateCode(secret1, time.Now())
+
+	ok, match, err := set.Validate("042"+code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, qux, match)
+	assert.Len(t, set.matchingKeys("042"+code, time.Now()), 1)
+	// Anonymous codes still work, and report both.
+	assert.Len(t, set.matchingKeys(code, time.Now()), 2)
+	// Wrong or unknown member numbers fall back to anonymous checking,
+	// where the whole input isn't a valid code.
+	assert.Empty(t, set.matchingKeys("043"+code, time.Now()))
+
+	set.RequireMemberNumber = true
+	assert.Empty(t, set.matchingKeys(code, time.Now()))
+	ok, match, err = set.Validate("041"+code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, baz, match)
+}
+
+func TestAnalyseWithMemberNumbers(t *testing.T) {
+	set := NewSet(5, NewKey("baz", secret1), NewKey("qux", secret2))
+	assert.InDelta(t, 9e-6, set.Analyse().Collision, 1e-9)
+	set.MemberNumberDigits = 3
+	set.RequireMemberNumber = true
+	a := set.Analyse()
+	assert.Equal(t, 2, a.Keys)
+	assert.InDelta(t, 3e-6, a.AttemptSuccess, 1e-12)
+	assert.Equal(t, 0.0, a.Collision)
+}
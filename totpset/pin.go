@@ -0,0 +1,180 @@
+package totpset
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for recovery codes and PINs. Each attempt checks only the
+// PINs of Keys its code is valid for, or the recovery code whose tag matches
+// the one typed, so these can be costlier than a per-attempt budget across
+// every member would allow.
+const (
+	hashN = 1 << 14
+	hashR = 8
+	hashP = 1
+)
+
+// minPINLength and maxPINLength bound the number of digits in a PIN.
+const (
+	minPINLength = 4
+	maxPINLength = 8
+)
+
+// ErrPINFormat is returned when setting a PIN that isn't 4 to 8 digits.
+var ErrPINFormat = errors.New("PIN must be 4 to 8 digits")
+
+// PINHash is a salted scrypt hash of a PIN. A PIN is short enough that it can
+// be found from its hash by trying every one, so the hash only keeps it from
+// being read at a glance; keep the accounts file itself safe too, eg. by
+// encrypting it.
+type PINHash struct {
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+// NewPINHash returns a hash of pin, which must be 4 to 8 digits.
+func NewPINHash(pin string) (*PINHash, error) {
+	if len(pin) < minPINLength || len(pin) > maxPINLength || strings.Trim(pin, "0123456789") != "" {
+		return nil, ErrPINFormat
+	}
+	salt, hash, err := newHash(pin)
+	if err != nil {
+		return nil, err
+	}
+	return &PINHash{Salt: salt, Hash: hash}, nil
+}
+
+// Matches reports whether pin is the PIN hashed.
+func (ph *PINHash) Matches(pin string) bool {
+	return hashMatches(pin, ph.Salt, ph.Hash)
+}
+
+// newHash returns a new random salt and the hash of secret with it.
+func newHash(secret string) (salt, hash []byte, err error) {
+	salt = make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+	hash, err = scrypt.Key([]byte(secret), salt, hashN, hashR, hashP, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return salt, hash, nil
+}
+
+// hashMatches reports whether hash is the hash of secret with salt.
+func hashMatches(secret string, salt, hash []byte) bool {
+	computed, err := scrypt.Key([]byte(secret), salt, hashN, hashR, hashP, len(hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+// codeLength returns the number of digits in the Key's codes.
+func (k *Key) codeLength() int {
+	if k.Type == Guest {
+		return len(k.Secret)
+	}
+	return k.ValidateOpts().Digits.Length()
+}
+
+// lookupPIN returns the matches found by lookup for passcode, for Keys without
+// a PIN; and the matches found for the end of passcode, for Keys with a PIN
+// whose codes are that long, with the rest of passcode as the PIN typed.
+func (ki *keyIndex) lookupPIN(passcode string, lookup func(code string) []indexMatch) []indexMatch {
+	var matches []indexMatch
+	for _, m := range lookup(passcode) {
+		if m.Key.PIN == nil {
+			matches = append(matches, m)
+		}
+	}
+	for _, digits := range ki.pinDigits {
+		if len(passcode) <= digits {
+			continue
+		}
+		pin, code := passcode[:len(passcode)-digits], passcode[len(passcode)-digits:]
+		for _, m := range lookup(code) {
+			if m.Key.PIN != nil && m.Key.codeLength() == digits {
+				m.pin = pin
+				matches = append(matches, m)
+			}
+		}
+	}
+	sort.Sort(byPosition(matches))
+	return matches
+}
+
+// checkPINs drops the matches for Keys with a PIN that wasn't typed with the
+// code. So that how long an attempt takes doesn't give away whether the code
+// was right, a PIN hash is checked on every attempt if any Key has a PIN.
+func (set *Set) checkPINs(matches []indexMatch) []indexMatch {
+	var checked []indexMatch
+	hashed := false
+	for _, m := range matches {
+		if m.Key.PIN == nil {
+			checked = append(checked, m)
+			continue
+		}
+		hashed = true
+		if m.Key.PIN.Matches(m.pin) {
+			checked = append(checked, m)
+		}
+	}
+	if !hashed && set.hasPINs() {
+		hashMatches("", dummySalt, dummyHash)
+	}
+	return checked
+}
+
+// dummySalt and dummyHash are checked by checkPINs when it has no PIN to
+// check.
+var (
+	dummySalt = make([]byte, 16)
+	dummyHash = make([]byte, 32)
+)
+
+// hasPINs reports whether any of the Set's Keys have a PIN. It is counted as
+// Keys change, as it's asked on every attempt.
+func (set *Set) hasPINs() bool {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	return set.pins > 0
+}
+
+// countPINs returns how many of keys have a PIN.
+func countPINs(keys []*Key) int {
+	n := 0
+	for _, k := range keys {
+		if k.PIN != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Redact returns passcode as it may be logged: a recovery code, typed after
+// the Set's RecoveryPrefix, is starred out entirely, as it would still be good
+// if refused, as is anything the length of an override code if the Set has
+// one; otherwise, if any of the Set's Keys have a PIN, everything before the
+// last 6 characters, which may include a PIN, is starred out.
+func (set *Set) Redact(passcode string) string {
+	const shown = 6
+	if prefix := set.RecoveryPrefix; prefix != "" && strings.HasPrefix(strings.TrimSpace(passcode), prefix) {
+		return prefix + strings.Repeat("*", len(strings.TrimSpace(passcode))-len(prefix))
+	}
+	if set.OverrideCode != nil && len(strings.TrimSpace(passcode)) == OverrideCodeLength {
+		return strings.Repeat("*", len(strings.TrimSpace(passcode)))
+	}
+	if len(passcode) <= shown || !set.hasPINs() {
+		return passcode
+	}
+	return strings.Repeat("*", len(passcode)-shown) + passcode[len(passcode)-shown:]
+}
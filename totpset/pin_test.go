@@ -0,0 +1,124 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPINHash(t *testing.T) {
+	ph, err := NewPINHash("1234")
+	assert.Nil(t, err)
+	assert.True(t, ph.Matches("1234"))
+	assert.False(t, ph.Matches("4321"))
+	assert.False(t, ph.Matches(""))
+	other, err := NewPINHash("1234")
+	assert.Nil(t, err)
+	assert.NotEqual(t, ph.Salt, other.Salt)
+	for _, pin := range []string{"123", "123456789", "12a4", ""} {
+		_, err = NewPINHash(pin)
+		assert.Equal(t, ErrPINFormat, err, pin)
+	}
+}
+
+func TestPINValidation(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	var err error
+	baz.PIN, err = NewPINHash("2468")
+	assert.Nil(t, err)
+	set := NewSet(5, baz, NewKey("qux", secret2))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+
+	// The code alone, or with the wrong PIN, is refused like a wrong code.
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, InvalidCode, result.Outcome)
+	assert.True(t, result.RateLimitedUntil.After(fake.Now()))
+	set.ResetRateLimit()
+	result, err = set.ValidateContext(context.Background(), "1357"+code)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, InvalidCode, result.Outcome)
+	assert.True(t, result.RateLimitedUntil.After(fake.Now()))
+	set.ResetRateLimit()
+
+	// Neither uses the code up.
+	result, err = set.ValidateContext(context.Background(), "2468"+code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.Equal(t, baz, result.Key())
+	// The PIN isn't logged.
+	for _, s := range logged {
+		assert.NotContains(t, s, "2468")
+	}
+
+	// Keys without a PIN don't take one.
+	code, _ = totp.GenerateCode(secret2, fake.Now())
+	_, err = set.ValidateContext(context.Background(), "2468"+code)
+	assert.Equal(t, ErrInvalidCode, err)
+	set.ResetRateLimit()
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, "qux", result.Key().Name)
+}
+
+func TestPINWithMemberNumber(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.MemberNumber = "042"
+	var err error
+	baz.PIN, err = NewPINHash("13579")
+	assert.Nil(t, err)
+	set := NewSet(0, baz)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set.Clock = fake
+	set.MemberNumberDigits = 3
+	set.RequireMemberNumber = true
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	_, err = set.ValidateContext(context.Background(), "042"+code)
+	assert.Equal(t, ErrInvalidCode, err)
+	result, err := set.ValidateContext(context.Background(), "04213579"+code)
+	assert.Nil(t, err)
+	assert.Equal(t, baz, result.Key())
+}
+
+func TestPINStored(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	var err error
+	baz.PIN, err = NewPINHash("2468")
+	assert.Nil(t, err)
+	encoded, err := json.Marshal(baz)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encoded), "2468")
+	reloaded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, reloaded))
+	assert.True(t, reloaded.PIN.Matches("2468"))
+	assert.NotContains(t, reloaded.Metadata, "pin")
+}
+
+func TestRedact(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	assert.Equal(t, "1234123456", set.Redact("1234123456"))
+	k := NewKey("qux", secret2)
+	k.PIN, _ = NewPINHash("1234")
+	set.SetKeys(k)
+	assert.Equal(t, "****123456", set.Redact("1234123456"))
+	assert.Equal(t, "123456", set.Redact("123456"))
+	// PINs are noticed however they come and go.
+	set.RemoveKey(k)
+	assert.Equal(t, "1234123456", set.Redact("1234123456"))
+	set.AddKeys(k)
+	assert.Equal(t, "****123456", set.Redact("1234123456"))
+	k.PIN = nil
+	set.Reindex()
+	assert.Equal(t, "1234123456", set.Redact("1234123456"))
+	k.PIN, _ = NewPINHash("1234")
+	assert.Equal(t, "****123456", NewSet(0, NewKey("baz", secret1), k).Redact("1234123456"))
+}
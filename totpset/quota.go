@@ -0,0 +1,210 @@
+package totpset
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultQuotaGrace is how soon after a counted visit a member may come back
+// in without using up another, eg. after stepping out for a phone call.
+const DefaultQuotaGrace = 15 * time.Minute
+
+var (
+	// ErrQuotaExhausted is returned when a code is valid but its Key has no
+	// visits left in its Quota.
+	ErrQuotaExhausted = errors.New("Visit quota used up")
+
+	// ErrQuotaSpec is returned for a quota that isn't eg. "10" or
+	// "10/month".
+	ErrQuotaSpec = errors.New("Quota must be a number of visits, optionally per day, week or month, eg. 10/month")
+)
+
+// QuotaPeriod is how often a Quota's visits are renewed.
+type QuotaPeriod string
+
+const (
+	// QuotaTotal visits are never renewed, eg. for a ten visit pass.
+	QuotaTotal QuotaPeriod = ""
+	// QuotaDay, QuotaWeek and QuotaMonth visits are renewed at the start
+	// of each calendar day, week (from Monday) and month, in local time.
+	QuotaDay   QuotaPeriod = "day"
+	QuotaWeek  QuotaPeriod = "week"
+	QuotaMonth QuotaPeriod = "month"
+)
+
+func (p QuotaPeriod) valid() bool {
+	switch p {
+	case QuotaTotal, QuotaDay, QuotaWeek, QuotaMonth:
+		return true
+	}
+	return false
+}
+
+// start returns the start of the period containing t, or the zero time for
+// QuotaTotal.
+func (p QuotaPeriod) start(t time.Time) time.Time {
+	t = t.Local()
+	switch p {
+	case QuotaDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case QuotaWeek:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	case QuotaMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Time{}
+	}
+}
+
+// Quota limits how many visits a Key lets in, eg. for day-pass memberships.
+// Its counts are kept with the Key and saved with CounterCallback as they
+// change.
+type Quota struct {
+	Visits uint
+	Period QuotaPeriod
+	// Used is the number of visits counted since Since, the start of the
+	// current period; LastVisit is when the latest was counted.
+	Used      uint
+	Since     time.Time
+	LastVisit time.Time
+}
+
+// ParseQuota reads a Quota written as by its String method, with no visits
+// used yet.
+func ParseQuota(spec string) (*Quota, error) {
+	visits, period := strings.TrimSpace(spec), ""
+	if split := strings.Index(visits, "/"); split >= 0 {
+		visits, period = strings.TrimSpace(visits[:split]), strings.ToLower(strings.TrimSpace(visits[split+1:]))
+	}
+	n, err := strconv.ParseUint(visits, 10, 32)
+	if err != nil {
+		return nil, ErrQuotaSpec
+	}
+	q := &Quota{Visits: uint(n), Period: QuotaPeriod(period)}
+	if !q.Period.valid() {
+		return nil, ErrQuotaSpec
+	}
+	return q, nil
+}
+
+// String returns the Quota's allowance, eg. "10/month", or "10" for
+// QuotaTotal.
+func (q Quota) String() string {
+	visits := strconv.FormatUint(uint64(q.Visits), 10)
+	if q.Period == QuotaTotal {
+		return visits
+	}
+	return visits + "/" + string(q.Period)
+}
+
+// Left returns the number of visits left at t.
+func (q Quota) Left(t time.Time) uint {
+	if !q.Period.start(t).Equal(q.Since) {
+		return q.Visits
+	}
+	if q.Used >= q.Visits {
+		return 0
+	}
+	return q.Visits - q.Used
+}
+
+// use counts a visit at t, unless it is within grace of the last one. It
+// returns whether the visit was counted, or ErrQuotaExhausted if there are no
+// visits left.
+func (q *Quota) use(t time.Time, grace time.Duration) (bool, error) {
+	if !q.LastVisit.IsZero() && !t.Before(q.LastVisit) && t.Sub(q.LastVisit) < grace {
+		return false, nil
+	}
+	if start := q.Period.start(t); !start.Equal(q.Since) {
+		q.Used, q.Since = 0, start
+	}
+	if q.Used >= q.Visits {
+		return false, ErrQuotaExhausted
+	}
+	q.Used++
+	q.LastVisit = t
+	return true, nil
+}
+
+// quotaRecord is how a Quota is stored.
+type quotaRecord struct {
+	Visits    uint   `json:"visits"`
+	Period    string `json:"per,omitempty"`
+	Used      uint   `json:"used,omitempty"`
+	Since     string `json:"since,omitempty"`
+	LastVisit string `json:"last visit,omitempty"`
+}
+
+// MarshalJSON encodes the Quota, leaving out counts not yet started.
+func (q Quota) MarshalJSON() ([]byte, error) {
+	return json.Marshal(quotaRecord{
+		Visits:    q.Visits,
+		Period:    string(q.Period),
+		Used:      q.Used,
+		Since:     formatDate(q.Since, false),
+		LastVisit: formatDate(q.LastVisit, false),
+	})
+}
+
+// UnmarshalJSON decodes a Quota encoded by MarshalJSON, or given as a string
+// for ParseQuota, as is handier when editing by hand.
+func (q *Quota) UnmarshalJSON(encoded []byte) error {
+	var spec string
+	if err := json.Unmarshal(encoded, &spec); err == nil {
+		parsed, err := ParseQuota(spec)
+		if err != nil {
+			return err
+		}
+		*q = *parsed
+		return nil
+	}
+	var record quotaRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return err
+	}
+	if !QuotaPeriod(record.Period).valid() {
+		return ErrQuotaSpec
+	}
+	since, err := parseDate(record.Since, false)
+	if err != nil {
+		return err
+	}
+	lastVisit, err := parseDate(record.LastVisit, false)
+	if err != nil {
+		return err
+	}
+	*q = Quota{Visits: record.Visits, Period: QuotaPeriod(record.Period), Used: record.Used, Since: since, LastVisit: lastVisit}
+	return nil
+}
+
+// useQuota counts a visit against k's Quota, if it has one, saving the new
+// count with CounterCallback. It returns ErrQuotaExhausted if there are no
+// visits left.
+func (set *Set) useQuota(k *Key, now time.Time, logCallback func(string)) error {
+	set.indexLock.Lock()
+	if k.Quota == nil {
+		set.indexLock.Unlock()
+		return nil
+	}
+	counted, err := k.Quota.use(now, set.QuotaGrace)
+	left := k.Quota.Left(now)
+	saved := k.snapshot()
+	set.indexLock.Unlock()
+	if err != nil || !counted {
+		if err == nil {
+			logCallback("Re-entry within grace period, visit not counted for " + k.Name)
+		}
+		return err
+	}
+	logCallback("Visit counted for " + k.Name + ", " + strconv.FormatUint(uint64(left), 10) + " left")
+	if set.CounterCallback != nil {
+		if err := set.CounterCallback(saved); err != nil {
+			logCallback("Failed to save quota for " + k.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
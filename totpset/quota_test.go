@@ -0,0 +1,180 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuota(t *testing.T) {
+	q, err := ParseQuota("10/Month")
+	assert.Nil(t, err)
+	assert.Equal(t, Quota{Visits: 10, Period: QuotaMonth}, *q)
+	assert.Equal(t, "10/month", q.String())
+	q, err = ParseQuota(" 10 ")
+	assert.Nil(t, err)
+	assert.Equal(t, Quota{Visits: 10, Period: QuotaTotal}, *q)
+	assert.Equal(t, "10", q.String())
+	for _, spec := range []string{"", "ten", "10/fortnight", "-1/day", "/day"} {
+		_, err = ParseQuota(spec)
+		assert.Equal(t, ErrQuotaSpec, err, spec)
+	}
+}
+
+func TestQuotaPeriods(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2016, time.April, 13, 15, 4, 5, 0, time.Local)
+	assert.Equal(t, time.Date(2016, time.April, 13, 0, 0, 0, 0, time.Local), QuotaDay.start(now))
+	assert.Equal(t, time.Date(2016, time.April, 11, 0, 0, 0, 0, time.Local), QuotaWeek.start(now))
+	assert.Equal(t, time.Date(2016, time.April, 1, 0, 0, 0, 0, time.Local), QuotaMonth.start(now))
+	assert.True(t, QuotaTotal.start(now).IsZero())
+	// Sundays are the end of the week.
+	sunday := time.Date(2016, time.April, 17, 23, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2016, time.April, 11, 0, 0, 0, 0, time.Local), QuotaWeek.start(sunday))
+}
+
+func TestQuotaUse(t *testing.T) {
+	q := &Quota{Visits: 2, Period: QuotaMonth}
+	now := time.Date(2016, time.April, 30, 20, 0, 0, 0, time.Local)
+	assert.Equal(t, uint(2), q.Left(now))
+	counted, err := q.use(now, 15*time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	// Coming back in within the grace period is free.
+	counted, err = q.use(now.Add(10*time.Minute), 15*time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, counted)
+	assert.Equal(t, uint(1), q.Left(now))
+	counted, err = q.use(now.Add(time.Hour), 15*time.Minute)
+	assert.True(t, counted)
+	_, err = q.use(now.Add(2*time.Hour), 15*time.Minute)
+	assert.Equal(t, ErrQuotaExhausted, err)
+	assert.Equal(t, uint(0), q.Left(now))
+	// A new month brings new visits.
+	next := time.Date(2016, time.May, 1, 9, 0, 0, 0, time.Local)
+	assert.Equal(t, uint(2), q.Left(next))
+	counted, err = q.use(next, 15*time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, uint(1), q.Left(next))
+}
+
+func TestQuotaJSON(t *testing.T) {
+	var k Key
+	assert.Nil(t, json.Unmarshal([]byte(`{"name": "baz", "secret": "GEZDGNBVGY3TQOJQ", "quota": "10/week"}`), &k))
+	assert.Equal(t, &Quota{Visits: 10, Period: QuotaWeek}, k.Quota)
+	assert.NotContains(t, k.Metadata, "quota")
+	k.Quota.use(time.Date(2016, time.April, 13, 15, 4, 5, 0, time.Local), 0)
+	encoded, err := json.Marshal(k)
+	assert.Nil(t, err)
+	assert.Contains(t, string(encoded), `"quota":{"visits":10,"per":"week","used":1,"since":"2016-04-11","last visit":`)
+	var reloaded Key
+	assert.Nil(t, json.Unmarshal(encoded, &reloaded))
+	assert.Equal(t, k.Quota.Used, reloaded.Quota.Used)
+	assert.True(t, k.Quota.Since.Equal(reloaded.Quota.Since))
+	assert.True(t, k.Quota.LastVisit.Equal(reloaded.Quota.LastVisit))
+	assert.Error(t, json.Unmarshal([]byte(`{"name": "baz", "quota": {"visits": 1, "per": "year"}}`), &k))
+}
+
+func TestSetQuota(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.Quota = &Quota{Visits: 1, Period: QuotaDay}
+	set := NewSet(5, baz)
+	set.QuotaGrace = DefaultQuotaGrace
+	fake := clock.NewFake(time.Date(2016, time.April, 13, 18, 0, 0, 0, time.Local))
+	set.Clock = fake
+	var saved []*Key
+	set.CounterCallback = func(k *Key) error {
+		saved = append(saved, k)
+		return nil
+	}
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	result, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.Equal(t, []*Key{baz}, saved)
+	assert.Equal(t, uint(1), baz.Quota.Used)
+
+	// Back in after stepping out.
+	fake.Advance(10 * time.Minute)
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+
+	// Not later though.
+	fake.Advance(time.Hour)
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrQuotaExhausted, err)
+	assert.Equal(t, QuotaExhausted, result.Outcome)
+	assert.Equal(t, "quota exhausted", result.Outcome.String())
+	assert.Equal(t, ErrQuotaExhausted.Error(), result.Reason)
+	assert.Equal(t, baz, result.Key())
+	assert.Equal(t, fake.Now().Add(5*time.Second), result.RateLimitedUntil)
+	assert.Equal(t, uint64(1), set.Usage("baz").Denials)
+	// The quota is renewed the next day.
+	fake.Set(time.Date(2016, time.April, 14, 9, 0, 0, 0, time.Local))
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+
+	// Visits refused by the time policy don't count.
+	fake.Set(time.Date(2016, time.April, 15, 9, 0, 0, 0, time.Local))
+	set.ValidityCallback = func(*Key, string) (bool, string) { return false, "closed" }
+	code, _ = totp.GenerateCode(secret1, fake.Now())
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, "closed", err.Error())
+	assert.Equal(t, uint(1), baz.Quota.Left(fake.Now()))
+}
+
+func TestRecoveryCodeQuota(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.Quota = &Quota{Visits: 1}
+	codes, err := baz.GenerateRecoveryCodes(2, testMasterKey)
+	assert.Nil(t, err)
+	set := NewSet(5, baz)
+	set.RecoveryPrefix = DefaultRecoveryPrefix
+	set.MasterKey = testMasterKey
+	fake := clock.NewFake(time.Date(2016, time.April, 13, 18, 0, 0, 0, time.Local))
+	set.Clock = fake
+	// A recovery code uses up a visit like any other code.
+	_, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+codes[0])
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), baz.Quota.Left(fake.Now()))
+	// And is refused once there are none left, without being used up.
+	fake.Advance(time.Hour)
+	result, err := set.ValidateContext(context.Background(), DefaultRecoveryPrefix+codes[1])
+	assert.Equal(t, ErrQuotaExhausted, err)
+	assert.Equal(t, QuotaExhausted, result.Outcome)
+	assert.True(t, result.Recovery)
+	assert.Equal(t, 1, baz.RecoveryCodesLeft())
+}
+
+func TestQuotaSavedConcurrently(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	baz.Quota = &Quota{Visits: 10}
+	set := NewSet(0, baz)
+	// Saving reads the Key while other visits are counted.
+	set.CounterCallback = func(k *Key) error {
+		_, err := json.Marshal(k)
+		return err
+	}
+	now := time.Date(2016, time.April, 13, 18, 0, 0, 0, time.Local)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, set.useQuota(baz, now, func(string) {}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint(5), baz.Quota.Left(now))
+}
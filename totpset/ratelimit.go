@@ -0,0 +1,207 @@
+package totpset
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RateLimiter decides how long a Set ignores attempts after each failure. Its
+// methods are called with the Set's rate limiting lock held, so they needn't
+// be safe for concurrent use themselves; but a RateLimiter shouldn't be shared
+// between Sets.
+type RateLimiter interface {
+	// Failure records a failed attempt at now, and returns when attempts
+	// may next be considered; now or earlier if straight away.
+	Failure(now time.Time) time.Time
+	// Success records an accepted attempt at now.
+	Success(now time.Time)
+	// Reset forgets all failures, eg. when an admin lifts the limit.
+	Reset()
+	// SustainedDelay is the average time each failure costs someone
+	// guessing continuously, for Analyse.
+	SustainedDelay() time.Duration
+	// State returns the RateLimiter's record of past attempts, as a JSON
+	// object, so that it can be saved and given to Restore after a restart;
+	// or nil if it keeps none. See Set.TrackState.
+	State() json.RawMessage
+	// Restore takes up a record of past attempts returned by State. Fields
+	// it doesn't know, eg. from a different kind of RateLimiter, are
+	// ignored.
+	Restore(state json.RawMessage) error
+}
+
+// FixedDelay ignores attempts for the same Delay after every failure. It is
+// what a Set without a RateLimiter does, with its RateLimitDuration.
+type FixedDelay struct {
+	Delay time.Duration
+}
+
+// NewFixedDelay returns a RateLimiter ignoring attempts for delay after every
+// failure.
+func NewFixedDelay(delay time.Duration) *FixedDelay {
+	return &FixedDelay{Delay: delay}
+}
+
+// Failure returns now plus the Delay.
+func (fd *FixedDelay) Failure(now time.Time) time.Time {
+	return now.Add(fd.Delay)
+}
+
+// Success does nothing.
+func (fd *FixedDelay) Success(now time.Time) {}
+
+// Reset does nothing.
+func (fd *FixedDelay) Reset() {}
+
+// SustainedDelay returns the Delay.
+func (fd *FixedDelay) SustainedDelay() time.Duration {
+	return fd.Delay
+}
+
+// State returns nil, as the Set keeps when attempts may next be made.
+func (fd *FixedDelay) State() json.RawMessage {
+	return nil
+}
+
+// Restore does nothing.
+func (fd *FixedDelay) Restore(state json.RawMessage) error {
+	return nil
+}
+
+// ExponentialBackoff ignores attempts for Initial after a failure, doubling
+// with each consecutive failure up to Max. An accepted attempt starts it
+// again from Initial, so a member who mistypes once waits no longer than
+// usual, while someone guessing soon waits Max between guesses.
+type ExponentialBackoff struct {
+	Initial  time.Duration
+	Max      time.Duration
+	failures uint
+}
+
+// NewExponentialBackoff returns a RateLimiter whose delay starts at initial
+// and doubles with each consecutive failure, up to max.
+func NewExponentialBackoff(initial, max time.Duration) *ExponentialBackoff {
+	return &ExponentialBackoff{Initial: initial, Max: max}
+}
+
+// Failure counts a consecutive failure and returns now plus the delay for it.
+func (eb *ExponentialBackoff) Failure(now time.Time) time.Time {
+	delay := eb.Initial
+	for i := uint(0); i < eb.failures && delay < eb.Max; i++ {
+		delay *= 2
+	}
+	if delay > eb.Max {
+		delay = eb.Max
+	}
+	eb.failures++
+	return now.Add(delay)
+}
+
+// Success resets the delay to Initial.
+func (eb *ExponentialBackoff) Success(now time.Time) {
+	eb.failures = 0
+}
+
+// Reset resets the delay to Initial.
+func (eb *ExponentialBackoff) Reset() {
+	eb.failures = 0
+}
+
+// SustainedDelay returns Max, as continuous guessing soon reaches it.
+func (eb *ExponentialBackoff) SustainedDelay() time.Duration {
+	return eb.Max
+}
+
+// exponentialState is how an ExponentialBackoff's State is saved.
+type exponentialState struct {
+	Failures uint `json:"consecutive failures"`
+}
+
+// State returns the number of consecutive failures.
+func (eb *ExponentialBackoff) State() json.RawMessage {
+	encoded, _ := json.Marshal(exponentialState{Failures: eb.failures})
+	return encoded
+}
+
+// Restore sets the number of consecutive failures.
+func (eb *ExponentialBackoff) Restore(state json.RawMessage) error {
+	var es exponentialState
+	if err := json.Unmarshal(state, &es); err != nil {
+		return err
+	}
+	eb.failures = es.Failures
+	return nil
+}
+
+// SlidingWindow allows up to Failures failed attempts in any period of length
+// Window without delay, and then ignores attempts until the earliest of them
+// is a Window old. This lets a member mistype a few times without waiting,
+// while capping how many guesses can be made in a Window.
+type SlidingWindow struct {
+	Failures int
+	Window   time.Duration
+	// Times of the failures within the last Window, oldest first.
+	recent []time.Time
+}
+
+// NewSlidingWindow returns a RateLimiter allowing failures failed attempts in
+// any period of length window.
+func NewSlidingWindow(failures int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{Failures: failures, Window: window}
+}
+
+// Failure records a failure, and returns now if fewer than Failures have been
+// made in the last Window, or else when the earliest of the last Failures
+// leaves the Window.
+func (sw *SlidingWindow) Failure(now time.Time) time.Time {
+	for len(sw.recent) > 0 && !now.Before(sw.recent[0].Add(sw.Window)) {
+		sw.recent = sw.recent[1:]
+	}
+	sw.recent = append(sw.recent, now)
+	failures := sw.Failures
+	if failures < 1 {
+		failures = 1
+	}
+	if len(sw.recent) < failures {
+		return now
+	}
+	return sw.recent[len(sw.recent)-failures].Add(sw.Window)
+}
+
+// Success does nothing; only failures count against the budget.
+func (sw *SlidingWindow) Success(now time.Time) {}
+
+// Reset forgets all failures.
+func (sw *SlidingWindow) Reset() {
+	sw.recent = nil
+}
+
+// SustainedDelay returns the Window shared between its Failures.
+func (sw *SlidingWindow) SustainedDelay() time.Duration {
+	if sw.Failures <= 0 {
+		return sw.Window
+	}
+	return sw.Window / time.Duration(sw.Failures)
+}
+
+// windowState is how a SlidingWindow's State is saved.
+type windowState struct {
+	Recent []time.Time `json:"recent failures"`
+}
+
+// State returns the times of the failures within the last Window.
+func (sw *SlidingWindow) State() json.RawMessage {
+	encoded, _ := json.Marshal(windowState{Recent: sw.recent})
+	return encoded
+}
+
+// Restore sets the times of the recent failures, which are dropped as they
+// leave the Window.
+func (sw *SlidingWindow) Restore(state json.RawMessage) error {
+	var ws windowState
+	if err := json.Unmarshal(state, &ws); err != nil {
+		return err
+	}
+	sw.recent = ws.Recent
+	return nil
+}
@@ -0,0 +1,70 @@
+package totpset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	now := time.Now()
+	eb := NewExponentialBackoff(time.Second, 10*time.Second)
+	for _, delay := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		assert.Equal(t, now.Add(delay*time.Second), eb.Failure(now))
+	}
+	eb.Success(now)
+	assert.Equal(t, now.Add(time.Second), eb.Failure(now))
+	assert.Equal(t, 10*time.Second, eb.SustainedDelay())
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Now()
+	sw := NewSlidingWindow(3, time.Hour)
+	assert.Equal(t, now, sw.Failure(now))
+	assert.Equal(t, now.Add(10*time.Minute), sw.Failure(now.Add(10*time.Minute)))
+	// The third failure in the hour uses up the budget until the first is
+	// an hour old.
+	assert.Equal(t, now.Add(time.Hour), sw.Failure(now.Add(20*time.Minute)))
+	assert.Equal(t, now.Add(70*time.Minute), sw.Failure(now.Add(time.Hour)))
+	// Much later, the budget is back.
+	assert.Equal(t, now.Add(3*time.Hour), sw.Failure(now.Add(3*time.Hour)))
+	sw.Reset()
+	assert.Empty(t, sw.recent)
+	assert.Equal(t, 20*time.Minute, sw.SustainedDelay())
+}
+
+func TestSetRateLimiter(t *testing.T) {
+	set := NewSet(5, NewKey("baz", secret1))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 9, 37, 0, 0, time.UTC))
+	set.Clock = fake
+	set.RateLimiter = NewExponentialBackoff(time.Minute, time.Hour)
+	ok, _, err := set.Validate("000000", nil)
+	assert.False(t, ok)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, fake.Now().Add(time.Minute), set.RateLimitedUntil())
+	// Lifting the limit by hand doesn't leave the backoff raised.
+	set.ResetRateLimit()
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	ok, _, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	set.Validate("000000", nil)
+	assert.Equal(t, fake.Now().Add(time.Minute), set.RateLimitedUntil())
+	fake.Advance(time.Minute)
+	set.Validate("000000", nil)
+	assert.Equal(t, fake.Now().Add(2*time.Minute), set.RateLimitedUntil())
+	assert.Equal(t, time.Hour, set.RateLimitDelay())
+
+	// A sliding window lets the first failures through at once.
+	set.RateLimiter = NewSlidingWindow(2, time.Hour)
+	set.ResetRateLimit()
+	_, _, err = set.Validate("000000", nil)
+	assert.Equal(t, ErrInvalidCode, err)
+	_, _, err = set.Validate("000000", nil)
+	assert.Equal(t, ErrInvalidCode, err)
+	_, _, err = set.Validate("000000", nil)
+	assert.Equal(t, ErrRateLimited, err)
+}
@@ -0,0 +1,311 @@
+package totpset
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DefaultRecoveryPrefix is a key sequence, typed before a recovery code,
+	// that a USB keypad can enter but that no other code contains.
+	DefaultRecoveryPrefix = "**"
+
+	// DefaultRecoveryCodes is how many recovery codes a member gets by
+	// default.
+	DefaultRecoveryCodes = 8
+
+	// RecoveryCodeLength is the number of digits in a recovery code, enough,
+	// hashed with scrypt, to resist guessing offline.
+	RecoveryCodeLength = 12
+)
+
+// recoveryTagSalt keeps the key recovery codes are tagged with apart from
+// anything else derived from the same master key.
+var recoveryTagSalt = []byte("formadoor recovery code tag")
+
+// ErrRecoveryCodeUsed is returned when a recovery code is valid but has
+// already been used.
+var ErrRecoveryCodeUsed = errors.New("Recovery code has already been used, rate limiting")
+
+// RecoveryCode is a single-use code a member can enter, after the Set's
+// RecoveryPrefix, when they can't generate their usual codes, eg. having lost
+// their phone. Only a salted hash of the code is kept.
+type RecoveryCode struct {
+	// Tag is an HMAC of the code keyed from the site master key, which a
+	// Set finds the code by, so that each attempt checks at most the hash
+	// of the code it names; see Set.MasterKey. It is no help in guessing the
+	// code without the master key. Codes without one, from before tags,
+	// are never matched; see Set.UntaggedRecoveryCodes.
+	Tag  []byte
+	Salt []byte
+	Hash []byte
+	// Used is when the code was used, or zero if it hasn't been.
+	Used time.Time
+}
+
+// recoveryRecord is how a RecoveryCode is stored.
+type recoveryRecord struct {
+	Tag  []byte `json:"tag,omitempty"`
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+	Used string `json:"used,omitempty"`
+}
+
+// MarshalJSON encodes the RecoveryCode, leaving out Used if it is zero.
+func (rc RecoveryCode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recoveryRecord{Tag: rc.Tag, Salt: rc.Salt, Hash: rc.Hash, Used: formatDate(rc.Used, false)})
+}
+
+// UnmarshalJSON decodes a RecoveryCode encoded by MarshalJSON.
+func (rc *RecoveryCode) UnmarshalJSON(encoded []byte) error {
+	var record recoveryRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return err
+	}
+	used, err := parseDate(record.Used, false)
+	if err != nil {
+		return err
+	}
+	*rc = RecoveryCode{Tag: record.Tag, Salt: record.Salt, Hash: record.Hash, Used: used}
+	return nil
+}
+
+// matches reports whether code, digits only, is this RecoveryCode. tag is
+// code's tag; the hash is only checked once the tags match, as hashing every
+// code a Set holds would let anyone at the keypad stall it.
+func (rc RecoveryCode) matches(code string, tag []byte) bool {
+	if rc.Tag == nil || !hmac.Equal(rc.Tag, tag) {
+		return false
+	}
+	return hashMatches(code, rc.Salt, rc.Hash)
+}
+
+// recoveryTagger returns a function tagging recovery codes with a key derived
+// from master, or nil if there is no master key.
+func recoveryTagger(master []byte) (func(code string) []byte, error) {
+	if len(master) == 0 {
+		return nil, nil
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, recoveryTagSalt, nil), key); err != nil {
+		return nil, err
+	}
+	return func(code string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(code))
+		return mac.Sum(nil)
+	}, nil
+}
+
+// GenerateRecoveryCodes replaces the Key's recovery codes with n new ones,
+// returning them for the member to keep; they can't be got back afterwards.
+// Codes are grouped with dashes for reading, which are ignored when entered.
+// Each code is tagged with master, the site master key, and only a Set with
+// the same MasterKey accepts it; ErrNoMasterKey is returned without one. If
+// the Key is in a Set, call this on a copy and ReplaceKey it in.
+func (k *Key) GenerateRecoveryCodes(n int, master []byte) ([]string, error) {
+	tagger, err := recoveryTagger(master)
+	if err != nil {
+		return nil, err
+	}
+	if tagger == nil {
+		return nil, ErrNoMasterKey
+	}
+	codes := make([]string, n)
+	recovery := make([]RecoveryCode, n)
+	for i := range codes {
+		code, err := randomDigits(RecoveryCodeLength)
+		if err != nil {
+			return nil, err
+		}
+		salt, hash, err := newHash(code)
+		if err != nil {
+			return nil, err
+		}
+		recovery[i] = RecoveryCode{Tag: tagger(code), Salt: salt, Hash: hash}
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:]
+	}
+	k.RecoveryCodes = recovery
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns how many of the Key's recovery codes are unused.
+func (k *Key) RecoveryCodesLeft() int {
+	left := 0
+	for _, rc := range k.RecoveryCodes {
+		if rc.Used.IsZero() {
+			left++
+		}
+	}
+	return left
+}
+
+// UntaggedRecoveryCodes returns the Keys holding unused recovery codes
+// without a Tag, which the Set never accepts; give them new ones.
+func (set *Set) UntaggedRecoveryCodes() []*Key {
+	var untagged []*Key
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	for _, k := range set.keys {
+		for _, rc := range k.RecoveryCodes {
+			if rc.Tag == nil && rc.Used.IsZero() {
+				untagged = append(untagged, k)
+				break
+			}
+		}
+	}
+	return untagged
+}
+
+// findRecoveryCode returns the first Key with an unused recovery code matching
+// code, and its position in the Key's RecoveryCodes; or, if the code is only
+// found used, that Key and ErrRecoveryCodeUsed. Without a MasterKey no code
+// is found.
+func (set *Set) findRecoveryCode(code string) (*Key, int, error) {
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != RecoveryCodeLength {
+		return nil, 0, ErrInvalidCode
+	}
+	tagger, err := recoveryTagger(set.MasterKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if tagger == nil {
+		return nil, 0, ErrInvalidCode
+	}
+	tag := tagger(code)
+	var used *Key
+	for _, k := range set.Keys() {
+		set.indexLock.Lock()
+		recovery := append([]RecoveryCode(nil), k.RecoveryCodes...)
+		set.indexLock.Unlock()
+		for i, rc := range recovery {
+			if !rc.matches(code, tag) {
+				continue
+			}
+			if rc.Used.IsZero() {
+				return k, i, nil
+			}
+			used = k
+		}
+	}
+	if used != nil {
+		return used, 0, ErrRecoveryCodeUsed
+	}
+	return nil, 0, ErrInvalidCode
+}
+
+// claimRecoveryCode marks a Key's recovery code used at now, returning false
+// if a concurrent attempt got there first. Claims are given back with
+// releaseRecoveryCode if the attempt is refused after all.
+func (set *Set) claimRecoveryCode(k *Key, i int, now time.Time) bool {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	if i >= len(k.RecoveryCodes) || !k.RecoveryCodes[i].Used.IsZero() {
+		return false
+	}
+	// Copied on write, so that copies of the Key, such as a store's, don't
+	// see the claim.
+	recovery := append([]RecoveryCode(nil), k.RecoveryCodes...)
+	recovery[i].Used = now
+	k.RecoveryCodes = recovery
+	return true
+}
+
+func (set *Set) releaseRecoveryCode(k *Key, i int) {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	recovery := append([]RecoveryCode(nil), k.RecoveryCodes...)
+	recovery[i].Used = time.Time{}
+	k.RecoveryCodes = recovery
+}
+
+// validateRecovery checks code, entered after the RecoveryPrefix, against
+// every Key's recovery codes. The checks after a code is found are those
+// validate makes of other codes: the Key must be active, the ValidityCallback
+// must agree, the Key must still be in the Set, and it must have a visit of
+// its Quota left. Only then is the code used up, and the Key handed to
+// CounterCallback to save it.
+func (set *Set) validateRecovery(ctx context.Context, code string, now time.Time, logCallback func(string)) (ValidationResult, error) {
+	k, i, err := set.findRecoveryCode(code)
+	if err == ErrRecoveryCodeUsed {
+		logCallback("Recovery code has already been used, for: " + k.Name)
+		return ValidationResult{Outcome: CodeReused, Keys: []*Key{k}, Recovery: true, RateLimitedUntil: set.rateLimit()}, err
+	} else if err != nil {
+		logCallback("No matching recovery code found")
+		return ValidationResult{Outcome: InvalidCode, RateLimitedUntil: set.rateLimit()}, err
+	}
+	result := ValidationResult{Keys: []*Key{k}, Recovery: true}
+	if err = k.CheckActive(now); err != nil {
+		logCallback("Recovery code for '" + k.Name + "' but not active: " + err.Error())
+		set.recordUsage(k, Inactive, now, logCallback)
+		result.Outcome = Inactive
+		result.Reason = err.Error()
+		result.RateLimitedUntil = set.rateLimit()
+		return result, err
+	}
+	if !set.claimRecoveryCode(k, i, now) {
+		logCallback("Recovery code has already been used, for: " + k.Name)
+		result.Outcome = CodeReused
+		result.RateLimitedUntil = set.rateLimit()
+		return result, ErrRecoveryCodeUsed
+	}
+	refuse := func(outcome Outcome) {
+		set.releaseRecoveryCode(k, i)
+		result.Outcome = outcome
+	}
+	if set.ValidityCallback != nil {
+		ok, reason := set.ValidityCallback(k, code)
+		result.Reason = reason
+		if !ok {
+			logCallback("Recovery code for '" + k.Name + "' but not authorised: " + reason)
+			refuse(PolicyDenied)
+			set.recordUsage(k, PolicyDenied, now, logCallback)
+			result.RateLimitedUntil = set.rateLimit()
+			return result, policyDenial{reason: reason}
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		refuse(Cancelled)
+		return result, err
+	}
+	if !set.hasKey(k) {
+		logCallback("Key removed while validating: " + k.Name)
+		refuse(InvalidCode)
+		result.RateLimitedUntil = set.rateLimit()
+		return result, ErrInvalidCode
+	}
+	// Counted last, so that only visits let in use up the quota.
+	if err = set.useQuota(k, now, logCallback); err != nil {
+		logCallback("Recovery code for '" + k.Name + "' but quota used up: " + k.Quota.String())
+		refuse(QuotaExhausted)
+		result.Reason = err.Error()
+		set.recordUsage(k, QuotaExhausted, now, logCallback)
+		result.RateLimitedUntil = set.rateLimit()
+		return result, err
+	}
+	if set.CounterCallback != nil {
+		set.indexLock.Lock()
+		saved := k.snapshot()
+		set.indexLock.Unlock()
+		if err = set.CounterCallback(saved); err != nil {
+			logCallback("Failed to save used recovery code for " + k.Name + ": " + err.Error())
+		}
+	}
+	set.recordUsage(k, Accepted, now, logCallback)
+	set.rateSuccess(now)
+	set.saveState()
+	logCallback("Recovery code used by " + k.Name + ", " + strconv.Itoa(k.RecoveryCodesLeft()) + " left; follow up with them")
+	logCallback("Authenticated: " + k.Name)
+	result.Outcome = Accepted
+	return result, nil
+}
@@ -0,0 +1,127 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	codes, err := baz.GenerateRecoveryCodes(2, testMasterKey)
+	assert.Nil(t, err)
+	assert.Len(t, codes, 2)
+	assert.Len(t, codes[0], RecoveryCodeLength+2)
+	assert.Equal(t, 2, baz.RecoveryCodesLeft())
+	// Only hashes are kept.
+	encoded, err := json.Marshal(baz)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encoded), strings.Replace(codes[0], "-", "", -1))
+	assert.NotContains(t, string(encoded), `"used"`)
+
+	set := NewSet(5, NewKey("qux", secret2), baz)
+	set.RecoveryPrefix = DefaultRecoveryPrefix
+	set.MasterKey = testMasterKey
+	var saved []*Key
+	set.CounterCallback = func(k *Key) error {
+		saved = append(saved, k)
+		return nil
+	}
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	// Recovery codes are kept out of the logs, as one refused is still good.
+	assert.Equal(t, DefaultRecoveryPrefix+strings.Repeat("*", RecoveryCodeLength+2), set.Redact(DefaultRecoveryPrefix+codes[1]))
+	// Without the prefix it's just a wrong code.
+	result, err := set.ValidateContext(context.Background(), strings.Replace(codes[0], "-", "", -1))
+	assert.Equal(t, ErrInvalidCode, err)
+	set.ResetRateLimit()
+	logged = nil
+	// With it, digits only, the code is accepted once.
+	result, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+strings.Replace(codes[0], "-", "", -1))
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.True(t, result.Recovery)
+	assert.Equal(t, baz, result.Key())
+	assert.Equal(t, 1, baz.RecoveryCodesLeft())
+	assert.Equal(t, []*Key{baz}, saved)
+	assert.Contains(t, logged, "Recovery code used by baz, 1 left; follow up with them")
+	for _, line := range logged {
+		assert.NotContains(t, line, strings.Replace(codes[0], "-", "", -1))
+	}
+	result, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+codes[0])
+	assert.Equal(t, ErrRecoveryCodeUsed, err)
+	assert.Equal(t, CodeReused, result.Outcome)
+	set.ResetRateLimit()
+
+	// Used codes stay used once saved and reloaded.
+	encoded, err = json.Marshal(baz)
+	assert.Nil(t, err)
+	reloaded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, reloaded))
+	assert.Equal(t, 1, reloaded.RecoveryCodesLeft())
+	assert.WithinDuration(t, baz.RecoveryCodes[0].Used, reloaded.RecoveryCodes[0].Used, time.Second)
+
+	// A refused attempt doesn't use the code up.
+	set.ValidityCallback = func(*Key, string) (bool, string) { return false, "closed" }
+	result, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+codes[1])
+	assert.Equal(t, PolicyDenied, result.Outcome)
+	assert.Equal(t, 1, baz.RecoveryCodesLeft())
+	set.ResetRateLimit()
+	set.ValidityCallback = nil
+	baz.Suspended = true
+	_, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+codes[1])
+	assert.Equal(t, ErrKeySuspended, err)
+	assert.Equal(t, 1, baz.RecoveryCodesLeft())
+}
+
+func TestRecoveryCodesDisabled(t *testing.T) {
+	baz := NewKey("baz", secret1)
+	codes, err := baz.GenerateRecoveryCodes(1, testMasterKey)
+	assert.Nil(t, err)
+	set := NewSet(0, baz)
+	set.MasterKey = testMasterKey
+	ok, _, err := set.Validate(DefaultRecoveryPrefix+codes[0], nil)
+	assert.False(t, ok)
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, 1, baz.RecoveryCodesLeft())
+}
+
+func TestRecoveryCodeTags(t *testing.T) {
+	baz, qux := NewKey("baz", secret1), NewKey("qux", secret2)
+	_, err := baz.GenerateRecoveryCodes(1, nil)
+	assert.Equal(t, ErrNoMasterKey, err)
+	tagged, err := baz.GenerateRecoveryCodes(1, testMasterKey)
+	assert.Nil(t, err)
+	assert.NotNil(t, baz.RecoveryCodes[0].Tag)
+	// No digit of the code is kept in plain.
+	encoded, err := json.Marshal(baz)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encoded), tagged[0][:4])
+	reloaded := new(Key)
+	assert.Nil(t, json.Unmarshal(encoded, reloaded))
+	assert.Equal(t, baz.RecoveryCodes[0].Tag, reloaded.RecoveryCodes[0].Tag)
+	// Eg. given out before codes were tagged.
+	untagged, err := qux.GenerateRecoveryCodes(1, testMasterKey)
+	assert.Nil(t, err)
+	qux.RecoveryCodes[0].Tag = nil
+
+	// Only tagged codes are found, and only with the master key.
+	set := NewSet(0, qux, baz)
+	set.RecoveryPrefix = DefaultRecoveryPrefix
+	assert.Equal(t, []*Key{qux}, set.UntaggedRecoveryCodes())
+	_, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+tagged[0])
+	assert.Equal(t, ErrInvalidCode, err)
+	set.ResetRateLimit()
+	set.MasterKey = testMasterKey
+	_, err = set.ValidateContext(context.Background(), DefaultRecoveryPrefix+untagged[0])
+	assert.Equal(t, ErrInvalidCode, err)
+	set.ResetRateLimit()
+	result, err := set.ValidateContext(context.Background(), DefaultRecoveryPrefix+tagged[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "baz", result.Key().Name)
+	assert.Equal(t, 1, qux.RecoveryCodesLeft())
+}
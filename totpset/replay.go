@@ -0,0 +1,56 @@
+package totpset
+
+import "time"
+
+// usedCode is a Key and a time step (or counter, for HOTP and Guest Keys) at
+// which a code for that Key has been accepted.
+type usedCode struct {
+	key  *Key
+	step uint64
+}
+
+// claimUnused drops any matches whose code has already been accepted, and
+// marks the rest as accepted so that a concurrent attempt with the same code
+// can't also be let in. Claims are given back with release if the attempt is
+// refused after all. Accepted codes are forgotten once they leave their
+// validity window or, for HOTP and Guest Keys, once the Counter passes them.
+// All matches are claimed and not only the Key that gets let in, or else a
+// colliding Key would let the code be replayed. A duress code shares the
+// claim of the genuine code for its Key and step: a code seen at the keypad
+// would otherwise be good again as soon as its last digit was changed under
+// IncrementLastDigit. So a duress code entered in the same step as the Key's
+// genuine code is refused as reused, though still flagged as duress.
+func (set *Set) claimUnused(matches []indexMatch, now time.Time) []indexMatch {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	if set.usedCodes == nil {
+		set.usedCodes = make(map[usedCode]time.Time)
+	}
+	for used, expires := range set.usedCodes {
+		if used.key.Type != TOTP {
+			if used.step < used.key.Counter {
+				delete(set.usedCodes, used)
+			}
+		} else if !now.Before(expires) {
+			delete(set.usedCodes, used)
+		}
+	}
+	var unused []indexMatch
+	for _, m := range matches {
+		used := usedCode{key: m.Key, step: m.Step}
+		if _, ok := set.usedCodes[used]; !ok {
+			set.usedCodes[used] = m.Expires
+			unused = append(unused, m)
+		}
+	}
+	return unused
+}
+
+// release forgets claims made by claimUnused.
+func (set *Set) release(matches []indexMatch) {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	for _, m := range matches {
+		delete(set.usedCodes, usedCode{key: m.Key, step: m.Step})
+	}
+}
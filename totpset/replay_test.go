@@ -0,0 +1,70 @@
+package totpset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeReuse(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1), NewKey("qux", secret2))
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	ok, match, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "baz", match.Name)
+	ok, match, err = set.Validate(code, nil)
+	assert.Equal(t, ErrCodeReused, err)
+	assert.False(t, ok)
+	assert.Nil(t, match)
+	// The other member is unaffected.
+	code, _ = totp.GenerateCode(secret2, time.Now())
+	ok, _, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestCodeReuseAllowed(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	set.AllowCodeReuse = true
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	for i := 0; i < 2; i++ {
+		ok, _, err := set.Validate(code, nil)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+}
+
+func TestUsedCodesExpire(t *testing.T) {
+	k := NewKey("baz", secret1)
+	set := NewSet(0, k)
+	now := time.Now()
+	code, _ := totp.GenerateCode(secret1, now)
+	matches := set.matchingKeys(code, now)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, matches, set.claimUnused(matches, now))
+	assert.Empty(t, set.claimUnused(matches, now))
+	assert.Len(t, set.usedCodes, 1)
+	set.release(matches)
+	assert.Equal(t, matches, set.claimUnused(matches, now))
+	assert.Equal(t, matches, set.claimUnused(matches, matches[0].Expires))
+	assert.Len(t, set.usedCodes, 1)
+}
+
+func TestPolicyDenialReleasesCode(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	allow := false
+	set.ValidityCallback = func(*Key, string) (bool, string) {
+		return allow, "not now"
+	}
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	ok, _, err := set.Validate(code, nil)
+	assert.False(t, ok)
+	assert.EqualError(t, err, "not now")
+	allow = true
+	ok, _, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
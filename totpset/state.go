@@ -0,0 +1,199 @@
+package totpset
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrStateCorrupt is returned by a StateStore whose saved State can't be read.
+var ErrStateCorrupt = errors.New("Saved rate limit state is corrupt")
+
+// State is what a Set would forget on a restart that someone guessing codes
+// could gain from: when attempts may next be made, its RateLimiter's record
+// of failures, its lockout, and the codes already used.
+type State struct {
+	NoAttemptsUntil time.Time       `json:"no attempts until"`
+	RateLimiter     json.RawMessage `json:"rate limiter,omitempty"`
+	Failures        []time.Time     `json:"failures,omitempty"`
+	Lockouts        int             `json:"lockouts,omitempty"`
+	LockedOutUntil  time.Time       `json:"locked out until"`
+	UsedCodes       []UsedCode      `json:"used codes,omitempty"`
+}
+
+// UsedCode is a code accepted for the Key with the given Name, at a time step
+// or counter, that mustn't be accepted again before it Expires.
+type UsedCode struct {
+	Name    string    `json:"name"`
+	Step    uint64    `json:"step"`
+	Expires time.Time `json:"expires"`
+}
+
+// StateStore keeps a Set's State between runs.
+type StateStore interface {
+	// LoadState returns the saved State, nil if there is none yet, or
+	// ErrStateCorrupt if it can't be read.
+	LoadState() (*State, error)
+	// SaveState replaces the saved State.
+	SaveState(state State) error
+}
+
+// TrackState restores the Set's State from store, and sets StateCallback to
+// save it back there as it changes. Call it once the Set has its Keys and
+// RateLimiter.
+//
+// If the saved State can't be loaded, the Set fails closed: it is locked out
+// for its BruteForce policy's MaxLockout, or DefaultBruteForcePolicy's, with
+// an Alarm, as though it had been attacked; and the error is returned.
+func (set *Set) TrackState(store StateStore) error {
+	set.StateCallback = store.SaveState
+	state, err := store.LoadState()
+	if err != nil {
+		set.failClosed(err)
+		return err
+	}
+	if state != nil {
+		if err = set.restoreState(*state); err != nil {
+			set.failClosed(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// failClosed locks the Set out after its State was lost to err.
+func (set *Set) failClosed(err error) {
+	policy := set.BruteForce
+	if policy == nil {
+		policy = &DefaultBruteForcePolicy
+	}
+	now := set.now()
+	alarm := Alarm{Time: now, Reason: "Rate limit state lost (" + err.Error() + ")", Lockouts: 1, Until: now.Add(policy.MaxLockout)}
+	set.rateLock.Lock()
+	set.lockout = lockoutState{lockouts: alarm.Lockouts, until: alarm.Until}
+	set.rateLock.Unlock()
+	set.raiseAlarm(alarm)
+	set.saveState()
+}
+
+// restoreState sets the Set's rate limit, lockout and used codes from state,
+// returning ErrStateCorrupt if the RateLimiter can't take up its part. Used
+// codes of Keys no longer in the Set are dropped.
+func (set *Set) restoreState(state State) error {
+	set.rateLock.Lock()
+	set.NoAttemptsUntil = state.NoAttemptsUntil
+	set.lockout = lockoutState{failures: state.Failures, lockouts: state.Lockouts, until: state.LockedOutUntil}
+	var err error
+	if set.RateLimiter != nil && state.RateLimiter != nil {
+		err = set.RateLimiter.Restore(state.RateLimiter)
+	}
+	set.rateLock.Unlock()
+	if err != nil {
+		return ErrStateCorrupt
+	}
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	byName := make(map[string]*Key, len(set.keys))
+	for _, k := range set.keys {
+		byName[k.Name] = k
+	}
+	if set.usedCodes == nil {
+		set.usedCodes = make(map[usedCode]time.Time)
+	}
+	for _, used := range state.UsedCodes {
+		if k, ok := byName[used.Name]; ok {
+			set.usedCodes[usedCode{key: k, step: used.Step}] = used.Expires
+		}
+	}
+	return nil
+}
+
+// saveState saves the Set's State with StateCallback, if set.
+func (set *Set) saveState() {
+	if set.StateCallback == nil {
+		return
+	}
+	// Held while saving, so that saves can't overtake each other.
+	set.stateLock.Lock()
+	defer set.stateLock.Unlock()
+	var state State
+	set.rateLock.Lock()
+	state.NoAttemptsUntil = set.NoAttemptsUntil
+	if set.RateLimiter != nil {
+		state.RateLimiter = set.RateLimiter.State()
+	}
+	state.Failures = append([]time.Time(nil), set.lockout.failures...)
+	state.Lockouts = set.lockout.lockouts
+	state.LockedOutUntil = set.lockout.until
+	set.rateLock.Unlock()
+	set.indexLock.Lock()
+	for used, expires := range set.usedCodes {
+		state.UsedCodes = append(state.UsedCodes, UsedCode{Name: used.key.Name, Step: used.step, Expires: expires})
+	}
+	set.indexLock.Unlock()
+	if err := set.StateCallback(state); err != nil && set.LogCallback != nil {
+		set.LogCallback("Failed to save rate limit state: " + err.Error())
+	}
+}
+
+// JSONStateFile keeps a State in a JSON file. Each save is synced to disk
+// before it replaces the last, so that cutting the power can't lose it.
+type JSONStateFile struct {
+	Filename string
+	lock     sync.Mutex
+}
+
+// NewJSONStateFile returns a store for the State in the file fn, which is
+// created on the first save if it doesn't exist.
+func NewJSONStateFile(fn string) *JSONStateFile {
+	return &JSONStateFile{Filename: fn}
+}
+
+// LoadState returns the State in the file, nil if there is no file yet, or
+// ErrStateCorrupt if it isn't a State.
+func (js *JSONStateFile) LoadState() (*State, error) {
+	contents, err := ioutil.ReadFile(js.Filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeState(contents)
+}
+
+// SaveState writes state to the file.
+func (js *JSONStateFile) SaveState(state State) error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	contents, err := marshalReadable(state, "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(js.Filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(contents); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(js.Filename+".tmp", js.Filename)
+}
+
+// decodeState reads a State encoded as JSON, returning ErrStateCorrupt if it
+// can't be.
+func decodeState(encoded []byte) (*State, error) {
+	state := new(State)
+	if err := json.Unmarshal(encoded, state); err != nil {
+		return nil, ErrStateCorrupt
+	}
+	return state, nil
+}
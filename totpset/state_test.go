@@ -0,0 +1,171 @@
+package totpset
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	testStateStore(t, NewJSONStateFile(filepath.Join(dir, "state.json")))
+}
+
+func TestBoltState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store, err := OpenBoltStore(filepath.Join(dir, "keys.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	testStateStore(t, store)
+}
+
+// newStateSet returns a Set as a restarted client would have it.
+func newStateSet(fake *clock.Fake) *Set {
+	set := NewSet(60, NewKey("baz", secret1))
+	set.Clock = fake
+	set.BruteForce = &BruteForcePolicy{Failures: 1, Window: time.Hour, Lockout: time.Hour, MaxLockout: 4 * time.Hour}
+	return set
+}
+
+// testStateStore checks an empty store keeps a Set's rate limit, lockout and
+// used codes across a restart.
+func testStateStore(t *testing.T, store StateStore) {
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set := newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	_, err := set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+
+	// A restart doesn't let the code be used again.
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrCodeReused, err)
+
+	// Nor lift the rate limit.
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrRateLimited, err)
+	assert.Equal(t, fake.Now().Add(time.Minute), set.RateLimitedUntil())
+
+	// Nor forget the failures towards a lockout, or the lockout itself.
+	fake.Advance(time.Minute)
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, fake.Now().Add(time.Hour), set.LockedOutUntil())
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	result, err := set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrLockedOut, err)
+	assert.Equal(t, fake.Now().Add(time.Hour), result.RateLimitedUntil)
+
+	// Clearing it is kept too.
+	set.ClearLockout()
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	assert.False(t, set.LockedOutUntil().After(fake.Now()))
+	assert.False(t, set.RateLimitedUntil().After(fake.Now()))
+}
+
+func TestStateCorruptFailsClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state.json")
+	// Eg. truncated by a power cut part way through writing.
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(`{"no attempts until": "2016-04-`), 0600))
+	store := NewJSONStateFile(fn)
+	_, err = store.LoadState()
+	assert.Equal(t, ErrStateCorrupt, err)
+
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+	set := newStateSet(fake)
+	var alarms []Alarm
+	set.AlarmCallback = func(a Alarm) { alarms = append(alarms, a) }
+	assert.Equal(t, ErrStateCorrupt, set.TrackState(store))
+	assert.Equal(t, fake.Now().Add(4*time.Hour), set.LockedOutUntil())
+	assert.Len(t, alarms, 1)
+	assert.Contains(t, alarms[0].String(), "Rate limit state lost ("+ErrStateCorrupt.Error()+"), locked out until")
+	code, _ := totp.GenerateCode(secret1, fake.Now())
+	_, err = set.ValidateContext(context.Background(), code)
+	assert.Equal(t, ErrLockedOut, err)
+
+	// The lockout is saved over the corrupt state, so outlasts a restart.
+	set = newStateSet(fake)
+	assert.Nil(t, set.TrackState(store))
+	assert.Equal(t, fake.Now().Add(4*time.Hour), set.LockedOutUntil())
+}
+
+// newLimitedSet returns a Set with limiter as a restarted client would have
+// it, with no lockout.
+func newLimitedSet(fake *clock.Fake, limiter RateLimiter) *Set {
+	set := NewSet(60, NewKey("baz", secret1))
+	set.Clock = fake
+	set.RateLimiter = limiter
+	return set
+}
+
+func TestRateLimiterState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 2, 0, 0, 0, time.UTC))
+
+	// A restart doesn't set the backoff back to its Initial delay.
+	store := NewJSONStateFile(filepath.Join(dir, "backoff.json"))
+	backoff := func() RateLimiter { return &ExponentialBackoff{Initial: time.Minute, Max: time.Hour} }
+	set := newLimitedSet(fake, backoff())
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	fake.Advance(time.Minute)
+	set = newLimitedSet(fake, backoff())
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, fake.Now().Add(2*time.Minute), set.RateLimitedUntil())
+	fake.Advance(2 * time.Minute)
+	set = newLimitedSet(fake, backoff())
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, fake.Now().Add(4*time.Minute), set.RateLimitedUntil())
+
+	// Nor forget the failures within a SlidingWindow.
+	store = NewJSONStateFile(filepath.Join(dir, "window.json"))
+	window := func() RateLimiter { return &SlidingWindow{Failures: 2, Window: time.Hour} }
+	set = newLimitedSet(fake, window())
+	assert.Nil(t, set.TrackState(store))
+	start := fake.Now()
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.False(t, set.RateLimitedUntil().After(fake.Now()))
+	fake.Advance(time.Minute)
+	set = newLimitedSet(fake, window())
+	assert.Nil(t, set.TrackState(store))
+	_, err = set.ValidateContext(context.Background(), "000000")
+	assert.Equal(t, ErrInvalidCode, err)
+	assert.Equal(t, start.Add(time.Hour), set.RateLimitedUntil())
+
+	// A RateLimiter's record that can't be taken up fails closed.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "window.json"), []byte(`{"rate limiter": {"recent failures": "soon"}}`), 0600))
+	set = newLimitedSet(fake, window())
+	set.BruteForce = &BruteForcePolicy{Failures: 1, Window: time.Hour, Lockout: time.Hour, MaxLockout: 4 * time.Hour}
+	assert.Equal(t, ErrStateCorrupt, set.TrackState(store))
+	assert.Equal(t, fake.Now().Add(4*time.Hour), set.LockedOutUntil())
+}
@@ -0,0 +1,220 @@
+package totpset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pquerna/otp"
+)
+
+// DefaultPollInterval is how often stores that can't be notified of changes
+// check for them while being watched.
+const DefaultPollInterval = 2 * time.Second
+
+// ErrKeyNotFound is returned by a KeyStore asked for a name it doesn't have.
+var ErrKeyNotFound = errors.New("No key with that name in store")
+
+// KeyStore is somewhere a roster of Keys is kept, so that several clients can
+// share the same member data. Keys are identified by Name.
+type KeyStore interface {
+	// Load returns every Key in the store.
+	Load() ([]*Key, error)
+	// Get returns the Key with the given Name, or ErrKeyNotFound.
+	Get(name string) (*Key, error)
+	// Save adds keys to the store, replacing any with the same Names.
+	Save(keys ...*Key) error
+	// Delete removes the Key with the given Name, or returns ErrKeyNotFound.
+	Delete(name string) error
+	// Watch calls changed with every Key in the store each time the store
+	// changes, until ctx is done, and then returns ctx.Err(). If the store
+	// can't be read after a change, changed gets the error instead.
+	Watch(ctx context.Context, changed func(keys []*Key, err error)) error
+}
+
+// NewSetFromStore returns a Set of the Keys in store, with the given seconds
+// of rate limiting. The Counters of HOTP Keys are saved back to the store as
+// they move, as are Guest Keys once used.
+func NewSetFromStore(rateLimitDurationSeconds int, store KeyStore) (*Set, error) {
+	keys, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	set := NewSet(rateLimitDurationSeconds, keys...)
+	set.CounterCallback = func(k *Key) error {
+		return store.Save(k)
+	}
+	return set, nil
+}
+
+// Follow keeps the Set's Keys the same as those in store until ctx is done,
+// so that members added to or removed from the store are let in or kept out
+// straight away. If the store can't be read, the Set keeps the Keys it has,
+// and the error goes to LogCallback.
+func (set *Set) Follow(ctx context.Context, store KeyStore) error {
+	return store.Watch(ctx, func(keys []*Key, err error) {
+		if err != nil {
+			if set.LogCallback != nil {
+				set.LogCallback("Error reading key store, keeping current keys: " + err.Error())
+			}
+			return
+		}
+		set.SetKeys(keys...)
+	})
+}
+
+// keyRecord is how a Key's own fields are stored. The names are those used by
+// totpClient's accounts file, so that file can be read as a JSONFileStore.
+type keyRecord struct {
+	Name          string         `json:"name"`
+	Secret        string         `json:"secret"`
+	MemberNumber  string         `json:"member number,omitempty"`
+	Digits        int            `json:"digits,omitempty"`
+	Period        uint           `json:"period,omitempty"`
+	Algorithm     string         `json:"algorithm,omitempty"`
+	Skew          *uint          `json:"skew,omitempty"`
+	Type          string         `json:"type,omitempty"`
+	Counter       uint64         `json:"counter,omitempty"`
+	LookAhead     uint           `json:"look ahead,omitempty"`
+	Drift         float64        `json:"drift,omitempty"`
+	NotBefore     string         `json:"not before,omitempty"`
+	NotAfter      string         `json:"not after,omitempty"`
+	Suspended     bool           `json:"suspended,omitempty"`
+	DuressSecret  string         `json:"duress secret,omitempty"`
+	PIN           *PINHash       `json:"pin,omitempty"`
+	Quota         *Quota         `json:"quota,omitempty"`
+	IssuedBy      string         `json:"issued by,omitempty"`
+	RecoveryCodes []RecoveryCode `json:"recovery codes,omitempty"`
+}
+
+// recordFields are the JSON names of keyRecord's fields, which can't also be
+// used for Metadata.
+var recordFields = map[string]bool{
+	"name": true, "secret": true, "member number": true, "digits": true, "period": true,
+	"algorithm": true, "skew": true, "type": true, "counter": true, "look ahead": true, "drift": true,
+	"not before": true, "not after": true, "suspended": true, "duress secret": true,
+	"pin": true, "quota": true, "issued by": true, "recovery codes": true,
+}
+
+// MarshalJSON encodes the Key as a JSON object, with its Metadata as extra
+// fields alongside its own. Parameters left at their defaults are omitted.
+func (k Key) MarshalJSON() ([]byte, error) {
+	record := keyRecord{
+		Name:          k.Name,
+		Secret:        k.Secret,
+		MemberNumber:  k.MemberNumber,
+		Digits:        int(k.Digits),
+		Period:        k.Period,
+		Skew:          k.Skew,
+		Counter:       k.Counter,
+		LookAhead:     k.LookAhead,
+		Drift:         k.Drift,
+		NotBefore:     formatDate(k.NotBefore, false),
+		NotAfter:      formatDate(k.NotAfter, true),
+		Suspended:     k.Suspended,
+		DuressSecret:  k.DuressSecret,
+		PIN:           k.PIN,
+		Quota:         k.Quota,
+		IssuedBy:      k.IssuedBy,
+		RecoveryCodes: k.RecoveryCodes,
+	}
+	if k.Derivation != nil {
+		// Only what the secret is derived from is stored.
+		record.Secret = k.Derivation.String()
+	}
+	if k.Algorithm != otp.AlgorithmSHA1 {
+		record.Algorithm = k.Algorithm.String()
+	}
+	if k.Type != TOTP {
+		record.Type = k.Type.String()
+	}
+	encoded, err := marshalReadable(record, "")
+	if err != nil {
+		return nil, err
+	}
+	extra := make(map[string]interface{}, len(k.Metadata))
+	for field, value := range k.Metadata {
+		if !recordFields[field] {
+			extra[field] = value
+		}
+	}
+	if len(extra) == 0 {
+		return encoded, nil
+	}
+	encodedExtra, err := marshalReadable(extra, "")
+	if err != nil {
+		return nil, err
+	}
+	// Splice the two objects together, the Key's own fields first.
+	encoded = append(bytes.TrimSuffix(encoded, []byte("}")), ',')
+	return append(encoded, bytes.TrimPrefix(encodedExtra, []byte("{"))...), nil
+}
+
+// UnmarshalJSON decodes a Key encoded by MarshalJSON. Any fields that aren't
+// the Key's own, such as a member's email address, go in its Metadata.
+func (k *Key) UnmarshalJSON(encoded []byte) error {
+	var record keyRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return err
+	}
+	algorithm, err := ParseAlgorithm(record.Algorithm)
+	if err != nil {
+		return err
+	}
+	keyType, err := ParseKeyType(record.Type)
+	if err != nil {
+		return err
+	}
+	notBefore, err := parseDate(record.NotBefore, false)
+	if err != nil {
+		return err
+	}
+	notAfter, err := parseDate(record.NotAfter, true)
+	if err != nil {
+		return err
+	}
+	*k = *NewKey(record.Name, record.Secret)
+	k.Type = keyType
+	k.MemberNumber = record.MemberNumber
+	k.Digits = otp.Digits(record.Digits)
+	k.Period = record.Period
+	k.Algorithm = algorithm
+	k.Skew = record.Skew
+	k.Counter = record.Counter
+	k.LookAhead = record.LookAhead
+	k.Drift = record.Drift
+	k.NotBefore = notBefore
+	k.NotAfter = notAfter
+	k.Suspended = record.Suspended
+	k.DuressSecret = record.DuressSecret
+	k.PIN = record.PIN
+	k.Quota = record.Quota
+	k.IssuedBy = record.IssuedBy
+	k.RecoveryCodes = record.RecoveryCodes
+	for field, value := range fields {
+		if !recordFields[field] {
+			k.Metadata[field] = value
+		}
+	}
+	return nil
+}
+
+// marshalReadable is json.MarshalIndent, but leaves characters like the '>'
+// in time policies as they are rather than escaping them for HTML, so that
+// files stay readable for hand editing.
+func marshalReadable(v interface{}, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,151 @@
+package totpset
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// accountsFile is in the format totpClient has always read.
+const accountsFile = `[
+  {"name": "baz", "email": "baz@example.com", "time policy": "[Mon:Sun]00:00->23:59", "secret": "GEZDGNBVGY3TQOJQ"},
+  {"name": "qux", "email": "qux@example.com", "time policy": "", "secret": "GSK7J7SAUCOQIWP2",
+   "member number": "042", "digits": 8, "algorithm": "SHA256", "skew": 0},
+  {"name": "fob", "email": "", "time policy": "", "secret": "GEZDGNBVGY3TQOJQ", "type": "hotp", "counter": 7}
+]`
+
+func TestKeyJSON(t *testing.T) {
+	var keys []*Key
+	assert.Nil(t, json.Unmarshal([]byte(accountsFile), &keys))
+	assert.Len(t, keys, 3)
+	assert.Equal(t, "baz", keys[0].Name)
+	assert.Equal(t, "baz@example.com", keys[0].Metadata["email"])
+	assert.Equal(t, "[Mon:Sun]00:00->23:59", keys[0].Metadata["time policy"])
+	assert.Equal(t, "042", keys[1].MemberNumber)
+	assert.Equal(t, otp.DigitsEight, keys[1].Digits)
+	assert.Equal(t, otp.AlgorithmSHA256, keys[1].Algorithm)
+	assert.Equal(t, uint(0), *keys[1].Skew)
+	assert.Equal(t, HOTP, keys[2].Type)
+	assert.Equal(t, uint64(7), keys[2].Counter)
+	// And back again.
+	encoded, err := json.Marshal(keys)
+	assert.Nil(t, err)
+	var decoded []*Key
+	assert.Nil(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, keys, decoded)
+	// Defaults are left out.
+	encoded, err = json.Marshal(NewKey("baz", secret1))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"baz","secret":"`+secret1+`"}`, string(encoded))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"name": "baz", "algorithm": "SHA3"}`), new(Key)))
+}
+
+func TestJSONFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "accounts.json")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte(accountsFile), 0600))
+	store := NewJSONFileStore(fn)
+	store.PollInterval = 10 * time.Millisecond
+	testKeyStore(t, store)
+	// The file is still fit for editing by hand.
+	contents, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Contains(t, string(contents), `"time policy": "[Mon:Sun]00:00->23:59"`)
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store, err := OpenBoltStore(filepath.Join(dir, "keys.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	store.PollInterval = 10 * time.Millisecond
+	var keys []*Key
+	assert.Nil(t, json.Unmarshal([]byte(accountsFile), &keys))
+	assert.Nil(t, store.Save(keys...))
+	testKeyStore(t, store)
+
+	// Changes made elsewhere, eg. by an admin command, are followed too.
+	set, err := NewSetFromStore(0, store)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go set.Follow(ctx, store)
+	time.Sleep(50 * time.Millisecond)
+	admin, err := OpenBoltStore(filepath.Join(dir, "keys.db"))
+	assert.Nil(t, err)
+	defer admin.Close()
+	assert.Nil(t, admin.Delete("quux"))
+	assert.True(t, eventually(func() bool { return len(set.Keys()) == 2 }))
+}
+
+// testKeyStore checks a store holding the accounts in accountsFile.
+func testKeyStore(t *testing.T, store KeyStore) {
+	keys, err := store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	k, err := store.Get("qux")
+	assert.Nil(t, err)
+	assert.Equal(t, "qux@example.com", k.Metadata["email"])
+	_, err = store.Get("quux")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	set, err := NewSetFromStore(0, store)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	followed := make(chan error)
+	go func() {
+		followed <- set.Follow(ctx, store)
+	}()
+	// Give Follow time to start watching.
+	time.Sleep(50 * time.Millisecond)
+
+	// Counters are saved as they move.
+	code, _ := hotp.GenerateCode("GEZDGNBVGY3TQOJQ", 7)
+	ok, _, err := set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	k, err = store.Get("fob")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), k.Counter)
+
+	// Members removed from the store are let in no longer.
+	assert.Nil(t, store.Delete("qux"))
+	assert.Equal(t, ErrKeyNotFound, store.Delete("qux"))
+	assert.True(t, eventually(func() bool { return len(set.Keys()) == 2 }))
+	// And added ones are.
+	assert.Nil(t, store.Save(NewKey("quux", secret2)))
+	assert.True(t, eventually(func() bool { return len(set.Keys()) == 3 }))
+	code, _ = totp.GenerateCode(secret2, time.Now())
+	ok, k, err = set.Validate(code, nil)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "quux", k.Name)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-followed)
+}
+
+// eventually reports whether condition becomes true within a second.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
@@ -1,13 +1,26 @@
 package totpset
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
 
+const (
+	// DefaultPeriod and DefaultSkew are used for Keys that don't set their
+	// own. Along with 6 digits and SHA1, they match the values used by
+	// totp.Validate, which is what Google Authenticator and most other
+	// clients expect.
+	DefaultPeriod = 30
+	DefaultSkew   = 1
+)
+
 var (
 	// ErrRateLimited is returned when an attempt is dropped because a Set is
 	// in rate limiting mode.
@@ -15,117 +28,395 @@ var (
 
 	// ErrInvalidCode is what it sounds like
 	ErrInvalidCode = errors.New("Invalid code, rate limiting")
+
+	// ErrCodeReused is returned when a code is valid but has already been
+	// accepted once, and the Set does not allow codes to be reused.
+	ErrCodeReused = errors.New("Code has already been used, rate limiting")
+
+	// ErrUnknownAlgorithm is returned by ParseAlgorithm for unsupported names.
+	ErrUnknownAlgorithm = errors.New("Unknown hash algorithm, must be one of SHA1, SHA256, SHA512 or MD5")
 )
 
 type Key struct {
 	Secret string
 	Name   string
+	Type   KeyType
+	// MemberNumber, if set, can be entered before a code to name the Key it
+	// is for; see Set.MemberNumberDigits.
+	MemberNumber string
+	// TOTP parameters. Zero values mean the defaults: 6 digits, DefaultPeriod
+	// seconds and SHA1. Skew is the number of periods either side of the
+	// current one to accept; nil means DefaultSkew.
+	// HOTP Keys use only Digits and Algorithm.
+	Digits    otp.Digits
+	Period    uint
+	Algorithm otp.Algorithm
+	Skew      *uint
+	// Drift is the learned offset, in time steps, of the clock generating a
+	// TOTP Key's codes, eg. -1 for a phone running a step slow. The Key's
+	// validation window is centred on it, rounded; see Set.MaxDrift.
+	Drift float64
+	// HOTP parameters. Counter is the counter of the next expected code, and
+	// codes up to LookAhead counters past it are accepted; zero means
+	// DefaultLookAhead. Guest Keys use Counter to mark their code used.
+	Counter   uint64
+	LookAhead uint
+	// NotBefore and NotAfter, if not zero, are the first and last moments
+	// the Key lets anyone in, eg. the start and end of a membership. A
+	// Suspended Key lets no one in until it is unsuspended. Codes for such
+	// Keys are still recognised, so the reason for refusing them can be given.
+	NotBefore time.Time
+	NotAfter  time.Time
+	Suspended bool
+	// PIN, if set, is the hash of a PIN the member types before each code,
+	// so that a code alone isn't enough; see NewPINHash.
+	PIN *PINHash
+	// Quota, if set, limits how many visits the Key lets in, eg. ten a
+	// month; see Set.QuotaGrace.
+	Quota *Quota
+	// RecoveryCodes are single-use codes the member can enter after the
+	// Set's RecoveryPrefix if they can't generate their usual codes; see
+	// GenerateRecoveryCodes.
+	RecoveryCodes []RecoveryCode
+	// IssuedBy names who created the Key, eg. the admin who issued a guest
+	// code, for the logs.
+	IssuedBy string
+	// Derivation, if set, is what Secret is derived from with a site master
+	// key, so that only it, and not Secret, is stored; see Set.MasterKey.
+	Derivation *Derivation
+	// DuressSecret, if set, is a second secret whose codes let the member in
+	// as usual but mark the attempt as made under duress; see
+	// ValidationResult.Duress. It uses the same parameters as Secret.
+	DuressSecret string
 	// Bag for stuff like email address, name, phone number, other such details.
 	// Implementing code can set and retrieve data from here.
 	Metadata map[string]interface{}
 }
 
+// NewKey returns a TOTP Key with the given Name and base32 Secret. Secret may
+// instead be a Derivation, eg. "derive:alice:1", in which case the Key has no
+// Secret until it is derived; see Key.Derive and Set.MasterKey.
 func NewKey(Name, Secret string) *Key {
 	k := new(Key)
 	k.Name = Name
 	k.Secret = Secret
+	if d, err := ParseDerivation(Secret); err == nil {
+		k.Derivation = d
+		k.Secret = ""
+	}
 	k.Metadata = make(map[string]interface{})
 	return k
 }
 
-func (k *Key) ValidateWithWGAndCallback(passcode string, wg *sync.WaitGroup, callback func(bool, *Key)) {
-	defer wg.Done()
-	if totp.Validate(passcode, k.Secret) {
-		callback(true, k)
+// snapshot returns a copy of the Key, with its own Quota, to hand to
+// CounterCallback, as the Key itself may be changed by another attempt while
+// the copy is saved. Call it with the Set's indexLock held.
+func (k *Key) snapshot() *Key {
+	c := *k
+	if k.Quota != nil {
+		q := *k.Quota
+		c.Quota = &q
 	}
+	return &c
 }
 
+// ValidateOpts returns the options to generate or validate this Key's codes
+// with, with defaults filled in for any parameters the Key doesn't set.
+func (k *Key) ValidateOpts() totp.ValidateOpts {
+	opts := totp.ValidateOpts{
+		Digits:    k.Digits,
+		Period:    k.Period,
+		Algorithm: k.Algorithm,
+		Skew:      DefaultSkew,
+	}
+	if opts.Digits == 0 {
+		opts.Digits = otp.DigitsSix
+	}
+	if opts.Period == 0 {
+		opts.Period = DefaultPeriod
+	}
+	if k.Skew != nil {
+		opts.Skew = *k.Skew
+	}
+	return opts
+}
+
+// ParseAlgorithm returns the otp.Algorithm named by name, as used in otpauth
+// URIs, eg. "SHA256". An empty name gives the default, SHA1.
+func ParseAlgorithm(name string) (otp.Algorithm, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "", "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	case "MD5":
+		return otp.AlgorithmMD5, nil
+	default:
+		return otp.AlgorithmSHA1, ErrUnknownAlgorithm
+	}
+}
+
+// Set is a roster of Keys checked together. Its Keys are changed with
+// AddKeys, RemoveKey, ReplaceKey and SetKeys, which are safe to call while
+// codes are being validated. The other fields are configuration, and should be
+// set before the Set is used.
 type Set struct {
-	Keys              []*Key
+	// RateLimitDuration is how long attempts are ignored after a failure,
+	// unless RateLimiter is set.
 	RateLimitDuration time.Duration
-	NoAttemptsUntil   time.Time
-	ValidityCallback  func(validated *Key, passcode string) (ok bool, reason string)
+	// RateLimiter, if set, decides how long attempts are ignored after each
+	// failure instead.
+	RateLimiter RateLimiter
+	// NoAttemptsUntil is when attempts will next be considered. While the Set
+	// is in use, read it with RateLimitedUntil and clear it with
+	// ResetRateLimit.
+	NoAttemptsUntil  time.Time
+	ValidityCallback func(validated *Key, passcode string) (ok bool, reason string)
+	// AllowCodeReuse permits a code that has already been accepted to be
+	// accepted again for the rest of its validity window. By default a used
+	// code is refused, so that it can't be replayed by someone watching the
+	// keypad; but this also means two people sharing an account can't both
+	// enter with the same code.
+	AllowCodeReuse bool
+	// CounterCallback, if set, is called with each HOTP Key whose Counter
+	// has moved, and each Key whose guest or recovery code has been used up,
+	// so the change can be saved. Otherwise a restart would let used codes be
+	// accepted again.
+	CounterCallback func(k *Key) error
+	// MemberNumberDigits, if not zero, is the length of a member number that
+	// may be entered before a code, so that the code is checked against that
+	// member's Key only; this avoids attributing an entry to the wrong member
+	// when codes collide. Codes entered without a member number are still
+	// checked against all Keys, unless RequireMemberNumber is set.
+	MemberNumberDigits  int
+	RequireMemberNumber bool
+	// Ambiguity decides what happens when a code is valid for more than one
+	// Key.
+	Ambiguity AmbiguityPolicy
+	// LogCallback, if set, receives the same messages from ValidateContext
+	// as Validate's logCallback does.
+	LogCallback func(string)
+	// MaxDrift, if not zero, enables learning each TOTP Key's Drift from the
+	// codes it has accepted, up to this many time steps either way, so that
+	// members whose phone clocks are off can still get in.
+	MaxDrift int
+	// RecoveryPrefix, if set, marks a passcode as a recovery code when typed
+	// before it, eg. DefaultRecoveryPrefix; see Key.RecoveryCodes. Recovery
+	// codes are found by their tags, so need a MasterKey.
+	RecoveryPrefix string
+	// DuressTransform, if set, turns each genuine code into a duress code
+	// for the same Key, eg. IncrementLastDigit. This gives every member a
+	// duress code without a second secret to enroll.
+	DuressTransform func(code string) string
+	// UsageCallback, if set, is called with a Key's Name and Usage each time
+	// the Usage changes, so it can be saved; see TrackUsage.
+	UsageCallback func(name string, u Usage) error
+	// BruteForce, if set, locks out every attempt for a long time when
+	// failures look like someone guessing codes, raising an Alarm with
+	// AlarmCallback; see DefaultBruteForcePolicy.
+	BruteForce    *BruteForcePolicy
+	AlarmCallback func(Alarm)
+	// OverrideCode, if set, is the hash of a code that clears a lockout when
+	// entered during it; see NewOverrideCode.
+	OverrideCode *PINHash
+	// QuotaGrace is how soon after a visit counted against a Key's Quota
+	// the Key may let someone in again without counting another, eg.
+	// DefaultQuotaGrace. Zero counts every entry.
+	QuotaGrace time.Duration
+	// MasterKey is what the Secrets of Keys with a Derivation are derived
+	// from, when the Set indexes them.
+	MasterKey []byte
+	// StateCallback, if set, is called with the Set's State each time it
+	// changes, so it can be saved; see TrackState.
+	StateCallback func(State) error
+	// Clock, if set, tells the time codes, rate limits and Key lifetimes are
+	// checked against, instead of the system clock.
+	Clock clock.Clock
+	// keys are guarded by indexLock, along with everything built from them.
+	keys      []*Key
+	index     *keyIndex
+	pins      int // How many of keys have a PIN.
+	indexLock sync.Mutex
+	rateLock  sync.Mutex
+	lockout   lockoutState
+	stateLock sync.Mutex
+	usedCodes map[usedCode]time.Time
+	// Usage by Key Name, so that it survives Keys being reloaded.
+	usage     map[string]Usage
+	usageLock sync.Mutex
 }
 
 // NewSet returns a prepared Set with the given seconds of rate limiting.
 func NewSet(rateLimitDurationSeconds int, keys ...*Key) *Set {
 	return &Set{
-		Keys:              keys,
+		keys:              append([]*Key(nil), keys...),
+		pins:              countPINs(keys),
 		ValidityCallback:  nil,
 		RateLimitDuration: time.Second * time.Duration(rateLimitDurationSeconds),
-		NoAttemptsUntil:   time.Now().Add(time.Second * -1),
 	}
 }
 
+// now returns the time by the Set's Clock.
+func (set *Set) now() time.Time {
+	return clock.Now(set.Clock)
+}
+
+// Reindex discards the Set's code index so it is rebuilt on the next attempt.
+// This is only needed if the secrets or parameters of Keys already in the Set
+// are modified in place; changes made through the Set's methods are noticed
+// automatically.
+func (set *Set) Reindex() {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	set.index = nil
+	set.pins = countPINs(set.keys)
+}
+
+// matchingKeys returns every Key for which passcode is currently valid, in the
+// order they appear in Keys. If passcode starts with a member number, only
+// the Keys with that number are considered; if none of them match, passcode
+// is treated as a code on its own unless RequireMemberNumber is set; guest
+// codes, which have no member number, are always accepted on their own.
+// Codes of Keys with a PIN are only matched with a PIN typed before them,
+// after any member number; the PIN is checked by checkPINs.
+func (set *Set) matchingKeys(passcode string, now time.Time) []indexMatch {
+	set.indexLock.Lock()
+	defer set.indexLock.Unlock()
+	if set.index == nil {
+		set.deriveSecrets(set.keys)
+		set.index = newKeyIndex(set.keys, set.DuressTransform)
+	}
+	set.index.refresh(now)
+	passcode = strings.TrimSpace(passcode)
+	if n := set.MemberNumberDigits; n > 0 && len(passcode) > n {
+		number := passcode[:n]
+		matches := set.index.lookupPIN(passcode[n:], func(code string) []indexMatch {
+			return set.index.lookupMember(number, code)
+		})
+		if len(matches) > 0 {
+			return matches
+		}
+	}
+	if set.RequireMemberNumber {
+		return set.index.lookupGuests(passcode)
+	}
+	return set.index.lookupPIN(passcode, set.index.lookup)
+}
+
 // Validate returns either a validated key and no error (great!),
 // or a key and an error preventing validation, or nil if validation simply
 // fails.
 // To avoid ambiguity, it also returns a boolean representing the final result;
 // validated or no.
 // If validation fails, then NoAttemptsUntil is set until <RateLimitDuration>
-// from now.
+// from now, or as long as the RateLimiter says.
+// Unless AllowCodeReuse is set, a code that has been accepted once is refused
+// with ErrCodeReused until it leaves the validity window.
+// Validate is safe to call from several goroutines at once.
 func (set *Set) Validate(passcode string, logCallback func(string)) (bool, *Key, error) {
-	if logCallback == nil {
-		logCallback = func(s string) {}
-	}
-	logCallback("Testing passcode " + passcode + " against key set.")
-	if time.Now().Before(set.NoAttemptsUntil) {
-		logCallback("Rate limited, validation aborted.")
-		return false, nil, ErrRateLimited
-	}
-	wg := new(sync.WaitGroup)
-	wg.Add(1) // So it doesn't return on the below wait immediately; this is
-	// .Done()'d after the below for-loop.
-	// Resulting Key is sent on this channel, or it's closed.
-	c := make(chan *Key)
-	// When all keys have had a chance to validate, if none succeed the channel
-	// is closed and will therefore return nil.
-	go func(wg *sync.WaitGroup, c chan *Key) {
-		wg.Wait()
-		close(c)
-	}(wg, c)
-	// Callback sent to keys when validating. It ensures the channel only sends
-	// once, but logs if duplicate keys validate for the provided code (important
-	// for accurate access logging)
-	someone_validated := false
-	cb := func(validated bool, key *Key) {
-		if validated || (!someone_validated) {
-			logCallback("Key validated: " + key.Name)
-			c <- key
-			someone_validated = true
-		} else {
-			logCallback("Additional key validated: " + key.Name)
-		}
+	ok, matches, err := set.ValidateMatches(passcode, logCallback)
+	if len(matches) == 0 || err == ErrAmbiguousCode || err == ErrReenterCode {
+		return ok, nil, err
 	}
-	// Dispatch validation challenge an callback to keys.
-	for _, k := range set.Keys {
-		wg.Add(1)
-		go k.ValidateWithWGAndCallback(passcode, wg, cb)
-	}
-	wg.Done() // To decrement by one and await the goroutines.
-	// Receive either a key or nil when the waitgroup returns and c is closed.
-	result := <-c
-	if result == nil {
-		logCallback("No matching valid code found for: " + passcode)
-		set.RateLimit()
-		return false, nil, ErrInvalidCode
-	} else {
-		// Key success!
-		// If a callback, do that to be sure.
-		if set.ValidityCallback != nil {
-			if ok, reason := set.ValidityCallback(result, passcode); !ok {
-				logCallback("Validated for '" + result.Name + "' but not authorised: " + reason)
-				set.RateLimit()
-				return false, result, errors.New(reason)
-			}
-		}
-		// No callback; we're good to go.
-		logCallback("Authenticated: " + result.Name)
-		return true, result, nil
+	return ok, matches[0], err
+}
+
+// ValidateMatches is Validate, but returns every Key the passcode is valid for
+// rather than just one. If the passcode is accepted, or refused by the
+// ValidityCallback, the Key concerned is the first of these. If it is valid
+// for more than one Key, what happens depends on the Set's Ambiguity policy.
+func (set *Set) ValidateMatches(passcode string, logCallback func(string)) (bool, []*Key, error) {
+	result, err := set.validate(context.Background(), passcode, logCallback)
+	return result.Outcome == Accepted, result.Keys, err
+}
+
+// rateLimited reports whether attempts are being ignored at now, and until
+// when.
+func (set *Set) rateLimited(now time.Time) (bool, time.Time) {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	return now.Before(set.NoAttemptsUntil), set.NoAttemptsUntil
+}
+
+// RateLimitedUntil returns when attempts will next be considered.
+func (set *Set) RateLimitedUntil() time.Time {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	return set.NoAttemptsUntil
+}
+
+// ResetRateLimit lets the next attempt be considered straight away, and has
+// the RateLimiter, if set, forget earlier failures.
+func (set *Set) ResetRateLimit() {
+	set.rateLock.Lock()
+	set.NoAttemptsUntil = set.now().Add(time.Second * -1)
+	if set.RateLimiter != nil {
+		set.RateLimiter.Reset()
 	}
+	set.rateLock.Unlock()
+	set.saveState()
 }
 
 // RateLimit sets this TOTPSet to reject input for the next few seconds (as configured)
 func (set *Set) RateLimit() {
-	set.NoAttemptsUntil = time.Now().Add(set.RateLimitDuration)
+	set.rateLimit()
+}
+
+// rateLimit is RateLimit, returning when attempts will next be considered.
+// It also counts the failure towards the BruteForce policy, if set, raising
+// an Alarm if that locks the Set out.
+func (set *Set) rateLimit() time.Time {
+	now := set.now()
+	set.rateLock.Lock()
+	if set.RateLimiter != nil {
+		set.NoAttemptsUntil = set.RateLimiter.Failure(now)
+	} else {
+		set.NoAttemptsUntil = now.Add(set.RateLimitDuration)
+	}
+	until := set.NoAttemptsUntil
+	var alarm *Alarm
+	if set.BruteForce != nil {
+		alarm = set.lockout.noteFailure(set.BruteForce, now)
+	}
+	if set.lockout.until.After(until) {
+		until = set.lockout.until
+	}
+	set.rateLock.Unlock()
+	if alarm != nil {
+		set.raiseAlarm(*alarm)
+	}
+	set.saveState()
+	return until
+}
+
+// rateSuccess tells the RateLimiter, if set, of an accepted attempt.
+func (set *Set) rateSuccess(now time.Time) {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	if set.RateLimiter != nil {
+		set.RateLimiter.Success(now)
+	}
+}
+
+// RateLimitDelay returns the average time each failure costs someone guessing
+// continuously: the RateLimiter's SustainedDelay if set, or else
+// RateLimitDuration; or longer, if BruteForce lockouts come sooner.
+func (set *Set) RateLimitDelay() time.Duration {
+	set.rateLock.Lock()
+	defer set.rateLock.Unlock()
+	delay := set.RateLimitDuration
+	if set.RateLimiter != nil {
+		delay = set.RateLimiter.SustainedDelay()
+	}
+	// Someone guessing continuously soon meets the longest lockout after
+	// every Failures+1 guesses.
+	if bf := set.BruteForce; bf != nil && bf.Failures >= 0 {
+		cycle := (bf.MaxLockout + time.Duration(bf.Failures)*delay) / time.Duration(bf.Failures+1)
+		if cycle > delay {
+			delay = cycle
+		}
+	}
+	return delay
 }
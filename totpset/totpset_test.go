@@ -6,6 +6,7 @@ import (
 
   "github.com/stretchr/testify/assert"
   "github.com/pquerna/otp/totp"
+  "github.com/cathalgarvey/formadoor/clock"
 )
 
 var (
@@ -30,33 +31,36 @@ func init() {
 
 func TestTOTPValidation(t *testing.T) {
   var code string
+  fake := clock.NewFake(time.Date(2016, time.April, 8, 9, 37, 0, 0, time.UTC))
+  testSet.Clock = fake
+  defer func() { testSet.Clock = nil }()
   // Should definitely fail (wrong length)
   code = "11111"
   ok, match, err := testSet.Validate(code, nil)
   assert.False(t, ok)
   assert.Nil(t, match)
   assert.Equal(t, ErrInvalidCode, err)
-  assert.True(t, testSet.NoAttemptsUntil.After(time.Now()))
+  assert.Equal(t, fake.Now().Add(5*time.Second), testSet.RateLimitedUntil())
   // Test rate limiting!
+  fake.Advance(4 * time.Second)
   ok, match, err = testSet.Validate(code, nil)
   assert.False(t, ok)
   assert.Nil(t, match)
   assert.Equal(t, ErrRateLimited, err)
-  assert.True(t, testSet.NoAttemptsUntil.After(time.Now()))
-  testSet.NoAttemptsUntil = time.Now().Add(time.Second * -1)
-  // Should probably fail (not deliberately correct)
-  code = "111111"
+  fake.Advance(time.Second)
+  // Should fail (not generated from either key at this time)
+  code, _ = totp.GenerateCode(secret1, fake.Now().Add(-time.Hour))
   ok, match, err = testSet.Validate(code, nil)
   assert.False(t, ok)
   assert.Nil(t, match)
   assert.Equal(t, ErrInvalidCode, err)
-  assert.True(t, testSet.NoAttemptsUntil.After(time.Now()))
-  testSet.NoAttemptsUntil = time.Now().Add(time.Second * -1)
+  assert.Equal(t, fake.Now().Add(5*time.Second), testSet.RateLimitedUntil())
+  fake.Advance(5 * time.Second)
   // Should succeed (generated from key, default skew should guarantee validity)
-  code = totp.GenerateCode(secret1, time.Now())
+  code, _ = totp.GenerateCode(secret1, fake.Now())
   ok, match, err = testSet.Validate(code, nil)
   assert.Nil(t, err)
   assert.True(t, ok)
   assert.Equal(t, secret1, match.Secret)
-  assert.False(t, testSet.NoAttemptsUntil.After(time.Now()))
+  assert.False(t, testSet.RateLimitedUntil().After(fake.Now()))
 }
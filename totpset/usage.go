@@ -0,0 +1,152 @@
+package totpset
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage counts the attempts made with a Key's codes, to tell when a member
+// last came in and to spot dormant accounts.
+type Usage struct {
+	// Successes are codes accepted, and Denials codes refused because the
+	// ValidityCallback said no, the Key wasn't active or its Quota was used
+	// up.
+	Successes   uint64    `json:"successes"`
+	Denials     uint64    `json:"denials"`
+	LastSuccess time.Time `json:"last success"`
+	LastDenial  time.Time `json:"last denial"`
+}
+
+// KeyUsage is the Usage of the Key with the given Name.
+type KeyUsage struct {
+	Name string
+	Usage
+}
+
+// UsageStore keeps Usage by Key Name between runs.
+type UsageStore interface {
+	// LoadUsage returns the Usage of every Key in the store.
+	LoadUsage() (map[string]Usage, error)
+	// SaveUsage records the Usage of one Key.
+	SaveUsage(name string, u Usage) error
+}
+
+// TrackUsage loads the Usage in store into the Set, and sets UsageCallback to
+// save changes back to it.
+func (set *Set) TrackUsage(store UsageStore) error {
+	usage, err := store.LoadUsage()
+	if err != nil {
+		return err
+	}
+	set.usageLock.Lock()
+	set.usage = usage
+	set.usageLock.Unlock()
+	set.UsageCallback = store.SaveUsage
+	return nil
+}
+
+// Usage returns the Usage of the Key with the given Name.
+func (set *Set) Usage(name string) Usage {
+	set.usageLock.Lock()
+	defer set.usageLock.Unlock()
+	return set.usage[name]
+}
+
+// UsageByLastUse returns the Usage of each of the Set's Keys, those unused the
+// longest first. Keys that have never been used come before all others.
+func (set *Set) UsageByLastUse() []KeyUsage {
+	keys := set.Keys()
+	set.usageLock.Lock()
+	usage := make([]KeyUsage, 0, len(keys))
+	for _, k := range keys {
+		usage = append(usage, KeyUsage{Name: k.Name, Usage: set.usage[k.Name]})
+	}
+	set.usageLock.Unlock()
+	sort.Stable(byLastSuccess(usage))
+	return usage
+}
+
+type byLastSuccess []KeyUsage
+
+func (u byLastSuccess) Len() int           { return len(u) }
+func (u byLastSuccess) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u byLastSuccess) Less(i, j int) bool { return u[i].LastSuccess.Before(u[j].LastSuccess) }
+
+// recordUsage counts an Accepted attempt, or one refused for a valid code,
+// against k, and saves the new Usage with UsageCallback if set.
+func (set *Set) recordUsage(k *Key, outcome Outcome, now time.Time, logCallback func(string)) {
+	// Saved before unlocking, so that saves can't overtake each other.
+	set.usageLock.Lock()
+	defer set.usageLock.Unlock()
+	if set.usage == nil {
+		set.usage = make(map[string]Usage)
+	}
+	u := set.usage[k.Name]
+	if outcome == Accepted {
+		u.Successes++
+		u.LastSuccess = now
+	} else {
+		u.Denials++
+		u.LastDenial = now
+	}
+	set.usage[k.Name] = u
+	if set.UsageCallback != nil {
+		if err := set.UsageCallback(k.Name, u); err != nil {
+			logCallback("Failed to save usage for " + k.Name + ": " + err.Error())
+		}
+	}
+}
+
+// JSONUsageFile keeps Usage in a file holding a JSON object of it by Key
+// Name. The file is rewritten on every change, which is fine at the rate
+// people come through a door.
+type JSONUsageFile struct {
+	Filename string
+	lock     sync.Mutex
+}
+
+// NewJSONUsageFile returns a store for the Usage in the file fn, which is
+// created on the first save if it doesn't exist.
+func NewJSONUsageFile(fn string) *JSONUsageFile {
+	return &JSONUsageFile{Filename: fn}
+}
+
+// LoadUsage returns the Usage in the file, or none if there is no file yet.
+func (ju *JSONUsageFile) LoadUsage() (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	contents, err := ioutil.ReadFile(ju.Filename)
+	if os.IsNotExist(err) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, &usage)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// SaveUsage writes the file with the Usage of one Key changed.
+func (ju *JSONUsageFile) SaveUsage(name string, u Usage) error {
+	ju.lock.Lock()
+	defer ju.lock.Unlock()
+	usage, err := ju.LoadUsage()
+	if err != nil {
+		return err
+	}
+	usage[name] = u
+	contents, err := marshalReadable(usage, "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(ju.Filename+".tmp", contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(ju.Filename+".tmp", ju.Filename)
+}
@@ -0,0 +1,94 @@
+package totpset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsage(t *testing.T) {
+	quux, err := NewRandomKey("quux")
+	assert.Nil(t, err)
+	baz, qux := NewKey("baz", secret1), NewKey("qux", secret2)
+	set := NewSet(0, baz, qux, quux)
+	set.AllowCodeReuse = true
+	var saved []string
+	set.UsageCallback = func(name string, u Usage) error {
+		saved = append(saved, name)
+		return nil
+	}
+	code, _ := totp.GenerateCode(secret2, time.Now())
+	ok, _, _ := set.Validate(code, nil)
+	assert.True(t, ok)
+	code, _ = totp.GenerateCode(secret1, time.Now())
+	ok, _, _ = set.Validate(code, nil)
+	assert.True(t, ok)
+	// Denied by policy, then refused as suspended.
+	set.ValidityCallback = func(*Key, string) (bool, string) { return false, "closed" }
+	ok, _, _ = set.Validate(code, nil)
+	assert.False(t, ok)
+	set.ValidityCallback = nil
+	baz.Suspended = true
+	ok, _, _ = set.Validate(code, nil)
+	assert.False(t, ok)
+	// Wrong codes aren't anyone's.
+	ok, _, _ = set.Validate("000000", nil)
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"qux", "baz", "baz", "baz"}, saved)
+	u := set.Usage("baz")
+	assert.Equal(t, uint64(1), u.Successes)
+	assert.Equal(t, uint64(2), u.Denials)
+	assert.False(t, u.LastDenial.Before(u.LastSuccess))
+	assert.Equal(t, Usage{}, set.Usage("quux"))
+
+	// Never used first, then least recently used.
+	var names []string
+	for _, u := range set.UsageByLastUse() {
+		names = append(names, u.Name)
+	}
+	assert.Equal(t, []string{"quux", "qux", "baz"}, names)
+
+	// Usage is kept by Name, so survives the Keys being reloaded.
+	set.SetKeys(NewKey("baz", secret1))
+	assert.Equal(t, uint64(1), set.Usage("baz").Successes)
+	assert.Len(t, set.UsageByLastUse(), 1)
+}
+
+func TestJSONUsageFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := NewJSONUsageFile(filepath.Join(dir, "usage.json"))
+	testUsageStore(t, store)
+}
+
+func TestBoltUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totpset")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store, err := OpenBoltStore(filepath.Join(dir, "keys.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	testUsageStore(t, store)
+}
+
+// testUsageStore checks an empty store keeps the Usage a Set records.
+func testUsageStore(t *testing.T, store UsageStore) {
+	set := NewSet(0, NewKey("baz", secret1))
+	assert.Nil(t, set.TrackUsage(store))
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	ok, _, _ := set.Validate(code, nil)
+	assert.True(t, ok)
+
+	set = NewSet(0, NewKey("baz", secret1))
+	assert.Nil(t, set.TrackUsage(store))
+	u := set.Usage("baz")
+	assert.Equal(t, uint64(1), u.Successes)
+	assert.WithinDuration(t, time.Now(), u.LastSuccess, time.Minute)
+}
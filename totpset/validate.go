@@ -0,0 +1,317 @@
+package totpset
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrPolicyDenied is matched, using errors.Is, by the error returned when a
+// code is valid but the Set's ValidityCallback refuses entry. The error's
+// message is the callback's reason.
+var ErrPolicyDenied = errors.New("Code is valid but entry is not permitted")
+
+// policyDenial carries a ValidityCallback's reason for refusing entry.
+type policyDenial struct {
+	reason string
+}
+
+func (pd policyDenial) Error() string {
+	return pd.reason
+}
+
+func (pd policyDenial) Is(target error) bool {
+	return target == ErrPolicyDenied
+}
+
+// Outcome is the overall result of validating a passcode.
+type Outcome int
+
+const (
+	// Accepted means the passcode is valid and entry is permitted. It
+	// starts from one so that an empty ValidationResult isn't Accepted.
+	Accepted Outcome = iota + 1
+	// RateLimited means the passcode was ignored, because of an earlier
+	// failure.
+	RateLimited
+	// InvalidCode means the passcode isn't valid for any Key.
+	InvalidCode
+	// CodeReused means the passcode was valid but has already been used,
+	// including a used recovery code.
+	CodeReused
+	// Ambiguous means the passcode is valid for more than one Key and was
+	// refused, either outright or asking for the next code, depending on the
+	// Set's Ambiguity policy.
+	Ambiguous
+	// PolicyDenied means the passcode is valid but the ValidityCallback
+	// refused entry.
+	PolicyDenied
+	// Inactive means the passcode is valid but its Key is suspended, a used
+	// guest code, or outside its NotBefore and NotAfter dates.
+	Inactive
+	// Cancelled means the context was done before validation finished.
+	Cancelled
+	// QuotaExhausted means the passcode is valid but its Key has no visits
+	// left in its Quota.
+	QuotaExhausted
+	// LockedOut means the passcode was ignored, because the Set is locked
+	// out after a suspected brute force attack.
+	LockedOut
+	// LockoutCleared means the passcode was the Set's OverrideCode, and the
+	// lockout has been lifted. No one is let in.
+	LockoutCleared
+)
+
+// String returns a short description of the outcome.
+func (o Outcome) String() string {
+	switch o {
+	case Accepted:
+		return "accepted"
+	case RateLimited:
+		return "rate limited"
+	case InvalidCode:
+		return "invalid code"
+	case CodeReused:
+		return "code reused"
+	case Ambiguous:
+		return "ambiguous"
+	case PolicyDenied:
+		return "policy denied"
+	case Inactive:
+		return "inactive"
+	case Cancelled:
+		return "cancelled"
+	case QuotaExhausted:
+		return "quota exhausted"
+	case LockedOut:
+		return "locked out"
+	case LockoutCleared:
+		return "lockout cleared"
+	default:
+		return "unknown"
+	}
+}
+
+// ValidationResult describes the outcome of validating a passcode.
+type ValidationResult struct {
+	Outcome Outcome
+	// Keys are all the Keys the passcode is valid for. If it was accepted,
+	// or refused by the ValidityCallback, the Key concerned is the first.
+	Keys []*Key
+	// Reason is what the ValidityCallback said about the first Key, if it
+	// was consulted.
+	Reason string
+	// StepOffset is how far the accepted code was from the one expected: in
+	// time steps for TOTP Keys, so -1 means the previous code, or in
+	// counters for HOTP Keys, so 2 means two presses were skipped.
+	StepOffset int
+	// RateLimitedUntil is when attempts will next be considered, if this
+	// attempt was ignored because of, or caused, a rate limit.
+	RateLimitedUntil time.Time
+	// Recovery means the passcode was one of the first Key's recovery codes,
+	// entered after the Set's RecoveryPrefix.
+	Recovery bool
+	// DriftGrowing means the clock generating the first Key's codes is
+	// further off than before, so its member should be told to correct it.
+	DriftGrowing bool
+	// Duress means the passcode was a duress code for the first Key. The
+	// Outcome is the same as for the genuine code, so nothing at the keypad
+	// gives it away; it's for the caller to raise the alarm, whether or not
+	// the passcode was Accepted.
+	Duress bool
+}
+
+// Key returns the first Key the passcode was valid for, or nil.
+func (vr ValidationResult) Key() *Key {
+	if len(vr.Keys) == 0 {
+		return nil
+	}
+	return vr.Keys[0]
+}
+
+// ValidateContext checks passcode against the Set, returning a description of
+// the outcome along with an error for any outcome but Accepted. The errors are
+// ErrRateLimited, ErrInvalidCode, ErrCodeReused, ErrAmbiguousCode,
+// ErrReenterCode, ErrKeySuspended, ErrGuestCodeUsed, ErrRecoveryCodeUsed,
+// ErrKeyNotYetValid, ErrKeyExpired, ErrQuotaExhausted, ErrLockedOut,
+// ErrLockoutCleared, an error matching ErrPolicyDenied, or the context's error;
+// compare them with errors.Is.
+// Messages about the attempt go to the Set's LogCallback.
+func (set *Set) ValidateContext(ctx context.Context, passcode string) (ValidationResult, error) {
+	return set.validate(ctx, passcode, set.LogCallback)
+}
+
+func (set *Set) validate(ctx context.Context, passcode string, logCallback func(string)) (ValidationResult, error) {
+	if logCallback == nil {
+		logCallback = func(s string) {}
+	}
+	if err := ctx.Err(); err != nil {
+		return ValidationResult{Outcome: Cancelled}, err
+	}
+	now := set.now()
+	// Nothing about attempts made during a lockout is logged, and Redact
+	// keeps override codes out of the logs.
+	locked, lockedUntil := set.lockedOut(now)
+	shown := set.Redact(strings.TrimSpace(passcode))
+	if !locked {
+		logCallback("Testing passcode " + shown + " against key set.")
+	}
+	// Override codes are rate limited like any other, so a locked out
+	// keypad can't be used to guess them at full speed.
+	if limited, until := set.rateLimited(now); limited {
+		if locked {
+			if lockedUntil.After(until) {
+				until = lockedUntil
+			}
+			logCallback("Locked out, validation aborted.")
+			return ValidationResult{Outcome: LockedOut, RateLimitedUntil: until}, ErrLockedOut
+		}
+		logCallback("Rate limited, validation aborted.")
+		return ValidationResult{Outcome: RateLimited, RateLimitedUntil: until}, ErrRateLimited
+	}
+	if set.isOverrideCode(passcode) {
+		return set.validateOverride(logCallback)
+	}
+	if locked {
+		return set.validateLockedOut(logCallback)
+	}
+	if prefix := set.RecoveryPrefix; prefix != "" && strings.HasPrefix(strings.TrimSpace(passcode), prefix) {
+		return set.validateRecovery(ctx, strings.TrimPrefix(strings.TrimSpace(passcode), prefix), now, logCallback)
+	}
+	// A wrong PIN looks the same as a wrong code, so gives nothing away.
+	matches := set.checkPINs(set.matchingKeys(passcode, now))
+	if len(matches) == 0 {
+		logCallback("No matching valid code found for: " + shown)
+		return ValidationResult{Outcome: InvalidCode, RateLimitedUntil: set.rateLimit()}, ErrInvalidCode
+	}
+	if !set.AllowCodeReuse {
+		claimed := set.claimUnused(matches, now)
+		if len(claimed) == 0 {
+			logCallback("Code has already been used: " + shown)
+			result := ValidationResult{Outcome: CodeReused, RateLimitedUntil: set.rateLimit()}
+			// A duress code is refused once its Key has been let in for
+			// the time step, but the alarm is still raised.
+			if m, ok := firstDuress(matches); ok {
+				result.Keys = []*Key{m.Key}
+				result.Duress = true
+			}
+			return result, ErrCodeReused
+		}
+		matches = claimed
+	}
+	// Inactive Keys can't let anyone in, nor make a code ambiguous; but if
+	// the code is only valid for inactive Keys, the first says why not.
+	if active, inactive := partitionActive(matches, now); len(active) == 0 {
+		err := matches[0].Key.CheckActive(now)
+		logCallback("Validated for '" + matches[0].Key.Name + "' but not active: " + err.Error())
+		if !set.AllowCodeReuse {
+			set.release(matches)
+		}
+		set.recordUsage(matches[0].Key, Inactive, now, logCallback)
+		return ValidationResult{
+			Outcome:          Inactive,
+			Keys:             []*Key{matches[0].Key},
+			Reason:           err.Error(),
+			StepOffset:       matches[0].Offset,
+			RateLimitedUntil: set.rateLimit(),
+			Duress:           matches[0].Duress,
+		}, err
+	} else if len(inactive) > 0 {
+		// Inactive Keys' claims are given back too; they can't be used to
+		// replay the code, and would otherwise linger.
+		if !set.AllowCodeReuse {
+			set.release(inactive)
+		}
+		matches = active
+	}
+	result := ValidationResult{
+		Keys:       make([]*Key, len(matches)),
+		StepOffset: matches[0].Offset,
+		Duress:     matches[0].Duress,
+	}
+	for i, m := range matches {
+		result.Keys[i] = m.Key
+	}
+	// Log if duplicate keys validate for the provided code (important for
+	// accurate access logging)
+	first := result.Keys[0]
+	logCallback("Key validated: " + first.Name)
+	if result.Duress {
+		logCallback("Code is a duress code for: " + first.Name)
+	}
+	for _, additional := range result.Keys[1:] {
+		logCallback("Additional key validated: " + additional.Name)
+	}
+	if len(matches) > 1 {
+		switch set.Ambiguity {
+		case RejectAmbiguous:
+			logCallback("Code is valid for more than one key, rejecting.")
+			// No one got in, so the members sharing the code keep it.
+			if !set.AllowCodeReuse {
+				set.release(matches)
+			}
+			result.Outcome = Ambiguous
+			result.RateLimitedUntil = set.rateLimit()
+			return result, ErrAmbiguousCode
+		case ReenterAmbiguous:
+			logCallback("Code is valid for more than one key, asking for the next code.")
+			result.Outcome = Ambiguous
+			return result, ErrReenterCode
+		}
+	}
+	// refuse gives back the claim on the code if the attempt is refused
+	// after all.
+	refuse := func(outcome Outcome) {
+		if !set.AllowCodeReuse {
+			set.release(matches)
+		}
+		result.Outcome = outcome
+	}
+	// Key success!
+	// If a callback, do that to be sure.
+	if set.ValidityCallback != nil {
+		ok, reason := set.ValidityCallback(first, passcode)
+		result.Reason = reason
+		if !ok {
+			logCallback("Validated for '" + first.Name + "' but not authorised: " + reason)
+			refuse(PolicyDenied)
+			set.recordUsage(first, PolicyDenied, now, logCallback)
+			result.RateLimitedUntil = set.rateLimit()
+			return result, policyDenial{reason: reason}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		refuse(Cancelled)
+		return result, err
+	}
+	// Or the Key was revoked while the ValidityCallback was deciding.
+	if !set.hasKey(first) {
+		logCallback("Key removed while validating: " + first.Name)
+		refuse(InvalidCode)
+		result.RateLimitedUntil = set.rateLimit()
+		return result, ErrInvalidCode
+	}
+	// Counted last, so that only visits let in use up the quota.
+	if err := set.useQuota(first, now, logCallback); err != nil {
+		logCallback("Validated for '" + first.Name + "' but quota used up: " + first.Quota.String())
+		refuse(QuotaExhausted)
+		result.Reason = err.Error()
+		set.recordUsage(first, QuotaExhausted, now, logCallback)
+		result.RateLimitedUntil = set.rateLimit()
+		return result, err
+	}
+	// No callback; we're good to go.
+	set.advanceCounters(matches, logCallback)
+	result.DriftGrowing = set.learnDrift(first, result.StepOffset, logCallback)
+	set.recordUsage(first, Accepted, now, logCallback)
+	set.rateSuccess(now)
+	if first.Type == Guest {
+		logCallback("Guest code used up: " + first.Name + ", issued by " + first.IssuedBy)
+	}
+	// The code is used now, including after a restart.
+	set.saveState()
+	logCallback("Authenticated: " + first.Name)
+	result.Outcome = Accepted
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package totpset
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/formadoor/clock"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateContext(t *testing.T) {
+	set := NewSet(5, NewKey("baz", secret1), newHOTPKey("fob", secret2))
+	fake := clock.NewFake(time.Date(2016, time.April, 8, 9, 37, 10, 0, time.UTC))
+	set.Clock = fake
+	var logged []string
+	set.LogCallback = func(s string) { logged = append(logged, s) }
+	set.ValidityCallback = func(k *Key, _ string) (bool, string) {
+		return k.Name == "baz", "only baz today"
+	}
+	ctx := context.Background()
+
+	code, _ := totp.GenerateCode(secret1, fake.Now().Add(-30*time.Second))
+	result, err := set.ValidateContext(ctx, code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	assert.Equal(t, "baz", result.Key().Name)
+	assert.Equal(t, -1, result.StepOffset)
+	assert.Equal(t, "only baz today", result.Reason)
+	assert.NotEmpty(t, logged)
+
+	result, err = set.ValidateContext(ctx, code)
+	assert.True(t, errors.Is(err, ErrCodeReused))
+	assert.Equal(t, CodeReused, result.Outcome)
+	assert.Nil(t, result.Key())
+	assert.True(t, result.RateLimitedUntil.After(fake.Now()))
+
+	result, err = set.ValidateContext(ctx, code)
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, RateLimited, result.Outcome)
+	assert.Equal(t, set.NoAttemptsUntil, result.RateLimitedUntil)
+	fake.Advance(5 * time.Second)
+
+	code, _ = hotp.GenerateCode(secret2, 1)
+	result, err = set.ValidateContext(ctx, code)
+	assert.True(t, errors.Is(err, ErrPolicyDenied))
+	assert.EqualError(t, err, "only baz today")
+	assert.Equal(t, PolicyDenied, result.Outcome)
+	assert.Equal(t, "fob", result.Key().Name)
+	assert.Equal(t, 1, result.StepOffset)
+	fake.Advance(5 * time.Second)
+
+	result, err = set.ValidateContext(ctx, "000000x")
+	assert.True(t, errors.Is(err, ErrInvalidCode))
+	assert.Equal(t, InvalidCode, result.Outcome)
+}
+
+func TestValidateContextCancelled(t *testing.T) {
+	set := NewSet(0, NewKey("baz", secret1))
+	ctx, cancel := context.WithCancel(context.Background())
+	set.ValidityCallback = func(*Key, string) (bool, string) {
+		cancel()
+		return true, ""
+	}
+	code, _ := totp.GenerateCode(secret1, time.Now())
+	result, err := set.ValidateContext(ctx, code)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, Cancelled, result.Outcome)
+	// The code wasn't used, so it's still good.
+	set.ValidityCallback = nil
+	result, err = set.ValidateContext(context.Background(), code)
+	assert.Nil(t, err)
+	assert.Equal(t, Accepted, result.Outcome)
+	_, err = set.ValidateContext(ctx, code)
+	assert.Equal(t, context.Canceled, err)
+}